@@ -2,54 +2,67 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"toolbox/jsonutil"
+	"toolbox/tracing"
 )
 
+// client carries the trace context of the request along to the logger.
+var client = &http.Client{Transport: tracing.Transport(nil)}
+
+// credentials is the body of Authenticate.
+type credentials struct {
+	Email    string `json:"email" validate:"required,email,max=255"`
+	Password string `json:"password" validate:"required,max=72"`
+}
+
+func init() {
+	jsonutil.MustCheckTags(credentials{})
+}
+
 func (app *Config) Authenticate(w http.ResponseWriter, r *http.Request) {
-	var requestPayload struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
-	}
+	var requestPayload credentials
 
-	err := app.readJSON(w, r, &requestPayload)
+	err := app.JSON.ReadJSON(w, r, &requestPayload)
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.JSON.ErrorJSON(w, err)
 		return
 	}
 
 	// validate the user against the database
 	user, err := app.Models.User.GetByEmail(requestPayload.Email)
 	if err != nil {
-		app.errorJSON(w, errors.New("invalid credentials"), http.StatusBadRequest)
+		app.JSON.ErrorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
 		return
 	}
 
 	valid, err := user.PasswordMatches(requestPayload.Password)
 	if err != nil || !valid {
-		app.errorJSON(w, errors.New("invalid credentials"), http.StatusBadRequest)
+		app.JSON.ErrorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
 		return
 	}
 
 	// log authentication
-	err = app.logRequest("authentication", fmt.Sprintf("%s logged in", user.Email))
+	err = app.logRequest(r.Context(), "authentication", fmt.Sprintf("%s logged in", user.Email))
 	if err != nil {
-		app.errorJSON(w, err)
+		app.JSON.ErrorJSON(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	payload := jsonResponse{
+	payload := jsonutil.Response{
 		Error:   false,
 		Message: fmt.Sprintf("Logged in user %s", user.Email),
 		Data:    user,
 	}
 
-	app.writeJSON(w, http.StatusAccepted, payload)
+	app.JSON.WriteJSON(w, http.StatusAccepted, payload)
 }
 
-func (app *Config) logRequest(name, data string) error {
+func (app *Config) logRequest(ctx context.Context, name, data string) error {
 	var entry struct {
 		Name string `json:"name"`
 		Data string `json:"data"`
@@ -61,12 +74,11 @@ func (app *Config) logRequest(name, data string) error {
 	jsonData, _ := json.MarshalIndent(entry, "", "\t")
 	logServiceURL := "http://logger-service/log"
 
-	request, err := http.NewRequest("POST", logServiceURL, bytes.NewBuffer(jsonData))
+	request, err := http.NewRequestWithContext(ctx, "POST", logServiceURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return err
 	}
 
-	client := &http.Client{}
 	_, err = client.Do(request)
 	if err != nil {
 		return err
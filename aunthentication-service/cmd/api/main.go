@@ -2,12 +2,15 @@ package main
 
 import (
 	"auth/data"
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"time"
+	"toolbox/jsonutil"
+	"toolbox/tracing"
 
 	_ "github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4"
@@ -21,11 +24,19 @@ var counts int64
 type Config struct {
 	DB     *sql.DB
 	Models data.Models
+	JSON   jsonutil.Tools
 }
 
 func main() {
 	log.Println("Starting authentication service")
 
+	// trace requests across the services
+	shutdownTracing, err := tracing.Init("authentication-service")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer shutdownTracing(context.Background())
+
 	// connect to DB
 	conn := connectToDB()
 	if conn == nil {
@@ -43,7 +54,7 @@ func main() {
 		Handler: app.routes(),
 	}
 
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	if err != nil {
 		log.Panic(err)
 	}
@@ -2,25 +2,23 @@ package main
 
 import (
 	"net/http"
+	"toolbox/tracing"
+	"toolbox/web"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/cors"
 )
 
 
 func (app *Config) routes() http.Handler {
 	mux := chi.NewRouter()
 
+	// trace every request, continuing the trace of the caller
+	mux.Use(tracing.Handler)
+
 	// specify who is allowed to connect
-	mux.Use(cors.Handler(cors.Options{
-		AllowedOrigins: []string{"https://*", "http://*"},
-		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders: []string{"Link"},
-		AllowCredentials: true,
-		MaxAge: 300,
-	}))
+	mux.Use(web.CORS(web.CORSOptions{}))
+	mux.Use(web.SecurityHeaders(web.SecurityOptions{}))
 
 	mux.Use(middleware.Heartbeat("/ping"))
 
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"toolbox/jsonutil"
+	"unicode"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+const (
+	TransportHTTP = "http"
+	TransportRPC  = "rpc"
+	TransportGRPC = "grpc"
+	TransportAMQP = "amqp"
+
+	defaultActionTimeout = 10 * time.Second
+)
+
+// Action describes one thing the broker can do on behalf of a client: where the
+// request goes, how it gets there and what its payload has to look like.
+type Action struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+
+	// Transport is one of http, rpc, grpc or amqp.
+	Transport string `json:"transport"`
+	// Target is a URL for http, host:port for rpc and grpc, and a routing key for amqp.
+	Target string `json:"target"`
+	// Method is the HTTP method (POST by default), the RPC method such as
+	// RPCServer.LogInfo, or the gRPC method such as logs.LogService/WriteLog.
+	Method string `json:"method,omitempty"`
+	// RequestField nests the payload under this field of the gRPC request message.
+	RequestField string `json:"request_field,omitempty"`
+	// Queue is a durable queue bound to Target for amqp actions, declared at startup
+	// so nothing is lost before its consumer first runs.
+	Queue string `json:"queue,omitempty"`
+	// IDField is where amqp actions put the tracking ID into the published payload.
+	IDField string `json:"id_field,omitempty"`
+
+	// Transports lets clients pick how the action is carried out. Each entry overrides
+	// the target settings above, and Transport names the one used by default.
+	Transports map[string]*TransportConfig `json:"transports,omitempty"`
+
+	// Downstream names the service the action calls, whose timeout, retries and
+	// circuit breaker then apply.
+	Downstream string `json:"downstream,omitempty"`
+	// Idempotent actions are retried after failures, as sending them twice is harmless.
+	Idempotent bool `json:"idempotent,omitempty"`
+
+	// Timeout bounds a single attempt; it defaults to the timeout of the downstream.
+	Timeout      Duration `json:"timeout,omitempty"`
+	AuthRequired bool     `json:"auth_required"`
+	// RateLimit and Quota, a rate per day, limit how often each client may run the
+	// action. Clients are told apart by user when they authenticate, else by IP.
+	RateLimit Rate `json:"rate_limit"`
+	Quota     Rate `json:"quota"`
+	// Message replaces the message of the downstream answer when set.
+	Message string `json:"message,omitempty"`
+
+	Schema             map[string]*FieldSchema `json:"schema,omitempty"`
+	AllowUnknownFields bool                    `json:"allow_unknown_fields,omitempty"`
+
+	// rpcArgs is the struct sent to rpc targets, built from the schema
+	rpcArgs reflect.Type
+	// grpcMethod is the resolved descriptor of Method for grpc targets
+	grpcMethod protoreflect.MethodDescriptor
+	// downstream is the resolved Downstream, if any
+	downstream *Downstream
+	// variants holds one prepared copy of the action per entry in Transports
+	variants map[string]*Action
+	// selectable is set on those copies, which all answer in the same shape
+	selectable bool
+}
+
+// TransportConfig is the target of an action over one particular transport.
+type TransportConfig struct {
+	Target       string   `json:"target"`
+	Method       string   `json:"method,omitempty"`
+	RequestField string   `json:"request_field,omitempty"`
+	Queue        string   `json:"queue,omitempty"`
+	IDField      string   `json:"id_field,omitempty"`
+	Downstream   string   `json:"downstream,omitempty"`
+	Timeout      Duration `json:"timeout,omitempty"`
+}
+
+// FieldSchema describes one field of an action payload.
+type FieldSchema struct {
+	// Type is string, number, integer, boolean, object, array or any, or a list of
+	// those when several are accepted.
+	Type      typeList `json:"type"`
+	Required  bool     `json:"required,omitempty"`
+	MaxLength int      `json:"max_length,omitempty"`
+	Enum      []string `json:"enum,omitempty"`
+	// Format is "email" for fields holding mail addresses.
+	Format string `json:"format,omitempty"`
+}
+
+// typeList is a list of type names. In JSON it may also be given as a single string.
+type typeList []string
+
+func (l *typeList) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*l = typeList{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return errors.New("type must be a string or an array of strings")
+	}
+	*l = list
+	return nil
+}
+
+func (l typeList) allows(kind string) bool {
+	for _, t := range l {
+		if t == kind || t == "any" || (t == "number" && kind == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// Duration is a time.Duration written as a string such as "5s" in JSON.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New(`duration must be a string such as "5s"`)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ActionRegistry holds every action the broker knows, loaded from a JSON file at startup.
+type ActionRegistry struct {
+	// Authenticator names the action used to check the credentials of requests to
+	// actions with auth_required set.
+	Authenticator string    `json:"authenticator,omitempty"`
+	Actions       []*Action `json:"actions"`
+	// Downstreams are the services called by the actions.
+	Downstreams []*Downstream `json:"downstreams,omitempty"`
+
+	byName      map[string]*Action
+	downstreams map[string]*Downstream
+}
+
+// LoadActionRegistry reads and checks the action configuration in file.
+func LoadActionRegistry(file string) (*ActionRegistry, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+
+	var reg ActionRegistry
+	if err := dec.Decode(&reg); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	reg.downstreams = make(map[string]*Downstream, len(reg.Downstreams))
+	for _, d := range reg.Downstreams {
+		if d.Name == "" {
+			return nil, fmt.Errorf("%s: downstream without a name", file)
+		}
+		if _, ok := reg.downstreams[d.Name]; ok {
+			return nil, fmt.Errorf("%s: downstream %q is defined twice", file, d.Name)
+		}
+		if err := d.prepare(); err != nil {
+			return nil, fmt.Errorf("%s: downstream %q: %w", file, d.Name, err)
+		}
+		reg.downstreams[d.Name] = d
+	}
+
+	reg.byName = make(map[string]*Action, len(reg.Actions))
+	for _, a := range reg.Actions {
+		if err := a.prepare(reg.downstreams); err != nil {
+			return nil, fmt.Errorf("%s: action %q: %w", file, a.Name, err)
+		}
+		if _, ok := reg.byName[a.Name]; ok {
+			return nil, fmt.Errorf("%s: action %q is defined twice", file, a.Name)
+		}
+		reg.byName[a.Name] = a
+	}
+
+	if reg.Authenticator != "" {
+		auth, ok := reg.byName[reg.Authenticator]
+		if !ok {
+			return nil, fmt.Errorf("%s: authenticator %q is not an action", file, reg.Authenticator)
+		}
+		if auth.AuthRequired {
+			return nil, fmt.Errorf("%s: authenticator %q cannot require authentication itself", file, reg.Authenticator)
+		}
+	}
+	for _, a := range reg.Actions {
+		if a.AuthRequired && reg.Authenticator == "" {
+			return nil, fmt.Errorf("%s: action %q requires authentication, but no authenticator is set", file, a.Name)
+		}
+	}
+	return &reg, nil
+}
+
+// Get returns the action with the given name.
+func (reg *ActionRegistry) Get(name string) (*Action, bool) {
+	a, ok := reg.byName[name]
+	return a, ok
+}
+
+// Downstream returns the downstream with the given name, or nil if there is none.
+func (reg *ActionRegistry) Downstream(name string) *Downstream {
+	return reg.downstreams[name]
+}
+
+// Breakers returns the state of the circuit breaker of every downstream.
+func (reg *ActionRegistry) Breakers() []BreakerState {
+	states := make([]BreakerState, 0, len(reg.Downstreams))
+	for _, d := range reg.Downstreams {
+		states = append(states, d.breaker.State())
+	}
+	return states
+}
+
+// Targets returns every prepared variant of every action, for setting up transports.
+func (reg *ActionRegistry) Targets() []*Action {
+	var targets []*Action
+	for _, a := range reg.Actions {
+		if len(a.variants) == 0 {
+			targets = append(targets, a)
+			continue
+		}
+		for _, v := range a.variants {
+			targets = append(targets, v)
+		}
+	}
+	return targets
+}
+
+// Via returns the action as carried out over transport, or over its default transport
+// when transport is empty.
+func (a *Action) Via(transport string) (*Action, error) {
+	if transport == "" || (len(a.variants) == 0 && transport == a.Transport) {
+		if len(a.variants) > 0 {
+			return a.variants[a.Transport], nil
+		}
+		return a, nil
+	}
+	v, ok := a.variants[transport]
+	if !ok {
+		return nil, fmt.Errorf("action %s cannot be sent via %s", a.Name, transport)
+	}
+	return v, nil
+}
+
+// prepare fills in defaults and checks that the action can actually be called.
+func (a *Action) prepare(downstreams map[string]*Downstream) error {
+	if a.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(a.Transports) > 0 {
+		return a.prepareVariants(downstreams)
+	}
+	if a.Target == "" {
+		return errors.New("target is required")
+	}
+	if a.Downstream != "" {
+		a.downstream = downstreams[a.Downstream]
+		if a.downstream == nil {
+			return fmt.Errorf("unknown downstream %q", a.Downstream)
+		}
+	}
+	if a.Quota.enabled() && a.Quota.Period != 24*time.Hour {
+		return errors.New(`quota must be a rate per day, such as "100/d"`)
+	}
+	if a.Timeout <= 0 {
+		a.Timeout = Duration(defaultActionTimeout)
+		if a.downstream != nil {
+			a.Timeout = a.downstream.Timeout
+		}
+	}
+	for name, field := range a.Schema {
+		if len(field.Type) == 0 {
+			return fmt.Errorf("field %s has no type", name)
+		}
+		for _, t := range field.Type {
+			switch t {
+			case "string", "number", "integer", "boolean", "object", "array", "any":
+			default:
+				return fmt.Errorf("field %s has unknown type %s", name, t)
+			}
+		}
+		if field.Format != "" && field.Format != "email" {
+			return fmt.Errorf("field %s has unknown format %s", name, field.Format)
+		}
+	}
+
+	switch a.Transport {
+	case TransportHTTP:
+		if a.Method == "" {
+			a.Method = "POST"
+		}
+	case TransportRPC:
+		if a.Method == "" {
+			return errors.New("rpc actions need a method")
+		}
+		args, err := rpcArgsType(a.Schema)
+		if err != nil {
+			return err
+		}
+		a.rpcArgs = args
+	case TransportGRPC:
+		service, method, ok := strings.Cut(a.Method, "/")
+		if !ok {
+			return errors.New("grpc actions need a method such as package.Service/Method")
+		}
+		desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(service))
+		if err != nil {
+			return fmt.Errorf("unknown grpc service %s", service)
+		}
+		sd, ok := desc.(protoreflect.ServiceDescriptor)
+		if !ok {
+			return fmt.Errorf("%s is not a grpc service", service)
+		}
+		a.grpcMethod = sd.Methods().ByName(protoreflect.Name(method))
+		if a.grpcMethod == nil {
+			return fmt.Errorf("grpc service %s has no method %s", service, method)
+		}
+	case TransportAMQP:
+	default:
+		return fmt.Errorf("unknown transport %q", a.Transport)
+	}
+	return nil
+}
+
+// prepareVariants prepares a copy of the action for each of its transports.
+func (a *Action) prepareVariants(downstreams map[string]*Downstream) error {
+	if _, ok := a.Transports[a.Transport]; !ok {
+		return fmt.Errorf("default transport %q is not among its transports", a.Transport)
+	}
+	a.variants = make(map[string]*Action, len(a.Transports))
+	for name, t := range a.Transports {
+		v := *a
+		v.Transport = name
+		v.Transports = nil
+		v.variants = nil
+		v.selectable = true
+		v.Target = t.Target
+		v.Method = t.Method
+		v.RequestField = t.RequestField
+		v.Queue = t.Queue
+		v.IDField = t.IDField
+		if t.Downstream != "" {
+			v.Downstream = t.Downstream
+		}
+		if t.Timeout > 0 {
+			v.Timeout = t.Timeout
+		}
+		if err := v.prepare(downstreams); err != nil {
+			return fmt.Errorf("via %s: %w", name, err)
+		}
+		a.variants[name] = &v
+	}
+	return nil
+}
+
+// rpcTraceField is the field of net/rpc arguments carrying the trace context.
+const rpcTraceField = "TraceContext"
+
+// rpcArgsType builds the struct passed to net/rpc methods. gob matches struct fields
+// by name, so a schema field "name" arrives in the field Name on the other side.
+func rpcArgsType(schema map[string]*FieldSchema) (reflect.Type, error) {
+	if len(schema) == 0 {
+		return nil, errors.New("rpc actions need a schema")
+	}
+	names := make([]string, 0, len(schema))
+	for name := range schema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := make([]reflect.StructField, 0, len(names))
+	for _, name := range names {
+		types := schema[name].Type
+		if len(types) != 1 {
+			return nil, fmt.Errorf("rpc field %s must have exactly one type", name)
+		}
+		var t reflect.Type
+		switch types[0] {
+		case "string":
+			t = reflect.TypeOf("")
+		case "integer":
+			t = reflect.TypeOf(int64(0))
+		case "number":
+			t = reflect.TypeOf(float64(0))
+		case "boolean":
+			t = reflect.TypeOf(false)
+		default:
+			return nil, fmt.Errorf("rpc field %s must be a string, integer, number or boolean", name)
+		}
+		if exportedName(name) == rpcTraceField {
+			return nil, fmt.Errorf("rpc field %s is reserved for the trace context", name)
+		}
+		fields = append(fields, reflect.StructField{
+			Name: exportedName(name),
+			Type: t,
+			Tag:  reflect.StructTag(fmt.Sprintf(`json:"%s"`, name)),
+		})
+	}
+	// servers without the field ignore it, gob only decodes the fields both sides have
+	fields = append(fields, reflect.StructField{
+		Name: rpcTraceField,
+		Type: reflect.TypeOf(map[string]string(nil)),
+		Tag:  `json:"-"`,
+	})
+	return reflect.StructOf(fields), nil
+}
+
+// exportedName turns reset_url into ResetUrl.
+func exportedName(name string) string {
+	var b strings.Builder
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == '-' }) {
+		r := []rune(part)
+		r[0] = unicode.ToUpper(r[0])
+		b.WriteString(string(r))
+	}
+	return b.String()
+}
+
+// Validate checks payload against the schema of the action and reports every field
+// at fault. Actions without a schema accept any payload.
+func (a *Action) Validate(payload json.RawMessage) *jsonutil.Error {
+	if len(a.Schema) == 0 {
+		return nil
+	}
+
+	var fields map[string]json.RawMessage
+	if len(bytes.TrimSpace(payload)) > 0 {
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			return jsonutil.NewError(http.StatusBadRequest, jsonutil.CodeInvalidJSON, a.Name+" payload must be a JSON object")
+		}
+	}
+
+	names := make([]string, 0, len(a.Schema)+len(fields))
+	for name := range a.Schema {
+		names = append(names, name)
+	}
+	for name := range fields {
+		if _, ok := a.Schema[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var problems []jsonutil.FieldError
+	for _, name := range names {
+		value, present := fields[name]
+		field, known := a.Schema[name]
+		switch {
+		case !known:
+			if !a.AllowUnknownFields {
+				problems = append(problems, jsonutil.FieldError{Field: name, Code: "unknown", Message: "is not a known field"})
+			}
+		case field.Required && blank(value):
+			problems = append(problems, jsonutil.FieldError{Field: name, Code: "required", Message: "is required"})
+		case present:
+			if problem, ok := field.check(value); !ok {
+				problem.Field = name
+				problems = append(problems, problem)
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	messages := make([]string, len(problems))
+	for i, p := range problems {
+		messages[i] = p.Field + " " + p.Message
+	}
+	err := jsonutil.NewError(http.StatusUnprocessableEntity, jsonutil.CodeValidation, a.Name+" payload: "+strings.Join(messages, "; "))
+	err.Fields = problems
+	return err
+}
+
+// blank reports whether a value leaves a required field unset: null, a blank string
+// or an empty array.
+func blank(value json.RawMessage) bool {
+	switch jsonKind(value) {
+	case "null":
+		return true
+	case "string":
+		var s string
+		return json.Unmarshal(value, &s) == nil && strings.TrimSpace(s) == ""
+	case "array":
+		var items []json.RawMessage
+		return json.Unmarshal(value, &items) == nil && len(items) == 0
+	}
+	return false
+}
+
+// check returns the first rule of the field value breaks.
+func (f *FieldSchema) check(value json.RawMessage) (jsonutil.FieldError, bool) {
+	kind := jsonKind(value)
+	if kind == "null" {
+		return jsonutil.FieldError{}, true
+	}
+	if !f.Type.allows(kind) {
+		return jsonutil.FieldError{Code: "type", Message: "must be of type " + strings.Join(f.Type, " or ")}, false
+	}
+
+	var strs []string
+	switch kind {
+	case "string":
+		var s string
+		if err := json.Unmarshal(value, &s); err != nil {
+			return jsonutil.FieldError{Code: "type", Message: err.Error()}, false
+		}
+		if f.MaxLength > 0 && utf8.RuneCountInString(s) > f.MaxLength {
+			return jsonutil.FieldError{Code: "max", Message: fmt.Sprintf("must be at most %d characters long", f.MaxLength)}, false
+		}
+		strs = []string{s}
+	case "array":
+		var items []json.RawMessage
+		if err := json.Unmarshal(value, &items); err != nil {
+			return jsonutil.FieldError{Code: "type", Message: err.Error()}, false
+		}
+		if f.MaxLength > 0 && len(items) > f.MaxLength {
+			return jsonutil.FieldError{Code: "max", Message: fmt.Sprintf("must have at most %d entries", f.MaxLength)}, false
+		}
+		if f.Format == "" && len(f.Enum) == 0 {
+			break
+		}
+		for _, item := range items {
+			var s string
+			if json.Unmarshal(item, &s) != nil {
+				return jsonutil.FieldError{Code: "type", Message: "must only contain strings"}, false
+			}
+			strs = append(strs, s)
+		}
+	}
+
+	for _, s := range strs {
+		if len(f.Enum) > 0 && !contains(f.Enum, s) {
+			return jsonutil.FieldError{Code: "oneof", Message: "must be one of " + strings.Join(f.Enum, ", ")}, false
+		}
+		if f.Format == "email" {
+			if _, err := mail.ParseAddress(s); err != nil {
+				return jsonutil.FieldError{Code: "email", Message: "must be a valid email address"}, false
+			}
+		}
+	}
+	return jsonutil.FieldError{}, true
+}
+
+// jsonKind returns the schema type of a JSON value, telling integers from other numbers.
+func jsonKind(value json.RawMessage) string {
+	value = bytes.TrimSpace(value)
+	if len(value) == 0 {
+		return "null"
+	}
+	switch value[0] {
+	case '"':
+		return "string"
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case 't', 'f':
+		return "boolean"
+	case 'n':
+		return "null"
+	}
+	if bytes.ContainsAny(value, ".eE") {
+		return "number"
+	}
+	return "integer"
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
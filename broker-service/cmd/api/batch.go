@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"toolbox/jsonutil"
+)
+
+const (
+	// maxBatchSize is the number of requests a single batch may hold.
+	maxBatchSize = 100
+	// defaultBatchParallelism is used when BROKER_BATCH_PARALLELISM is not set.
+	defaultBatchParallelism = 4
+)
+
+// batchRequest is the body of /handle/batch.
+type batchRequest struct {
+	// Requests are /handle requests, e.g. {"action": "log", "log": {...}}.
+	Requests []map[string]json.RawMessage `json:"requests"`
+	// StopOnError skips the requests not yet started once one has failed. By
+	// default every request is run, whatever happens to the others.
+	StopOnError bool `json:"stop_on_error"`
+	// Parallelism lowers the number of requests run at once below the broker's limit.
+	Parallelism int `json:"parallelism,omitempty"`
+}
+
+// batchResult is the outcome of one request of a batch.
+type batchResult struct {
+	Status  int  `json:"status"`
+	Skipped bool `json:"skipped,omitempty"`
+	jsonutil.Response
+	Errors []jsonutil.FieldError `json:"errors,omitempty"`
+}
+
+// HandleBatch runs several /handle requests at once and answers with their results
+// in the order they were sent.
+func (app *Config) HandleBatch(w http.ResponseWriter, r *http.Request) {
+	var batch batchRequest
+	err := app.JSON.ReadJSON(w, r, &batch)
+	if err != nil {
+		app.JSON.ErrorJSON(w, err)
+		return
+	}
+	if len(batch.Requests) == 0 {
+		app.JSON.ErrorJSON(w, errors.New("requests are required"))
+		return
+	}
+	if len(batch.Requests) > maxBatchSize {
+		app.JSON.ErrorJSON(w, fmt.Errorf("a batch may hold at most %d requests", maxBatchSize))
+		return
+	}
+	parallelism := app.BatchParallelism
+	if batch.Parallelism > 0 && batch.Parallelism < parallelism {
+		parallelism = batch.Parallelism
+	}
+
+	// credentials are checked once for the whole batch
+	auth := app.authorizeOnce(r)
+
+	results := make([]batchResult, len(batch.Requests))
+	var failed, stopped atomic.Bool
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, parallelism)
+	for i, request := range batch.Requests {
+		slots <- struct{}{}
+		if stopped.Load() {
+			<-slots
+			results[i] = batchResult{Skipped: true, Response: jsonutil.Response{Error: true, Message: "skipped after an earlier error"}}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, request map[string]json.RawMessage) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			res := app.dispatch(r, request, "", auth)
+			results[i] = batchResult{Status: res.Status, Response: res.Body, Errors: res.Fields}
+			if res.failed() {
+				failed.Store(true)
+				if batch.StopOnError {
+					stopped.Store(true)
+				}
+			}
+		}(i, request)
+	}
+	wg.Wait()
+
+	message := "all actions succeeded"
+	if failed.Load() {
+		message = "some actions failed"
+	}
+	payload := jsonutil.Response{
+		Error:   false,
+		Message: message,
+		Data:    results,
+	}
+	app.JSON.WriteJSON(w, http.StatusOK, payload)
+}
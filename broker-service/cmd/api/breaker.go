@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+
+	defaultFailureThreshold = 5
+	defaultOpenFor          = 30 * time.Second
+
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 2 * time.Second
+)
+
+// Downstream is a service the broker calls. Its settings apply to every action
+// sending requests to it.
+type Downstream struct {
+	Name string `json:"name"`
+	// Timeout bounds a single attempt, unless the action sets its own.
+	Timeout Duration `json:"timeout,omitempty"`
+	// Retries is how many more attempts idempotent actions get after a failure.
+	Retries int `json:"retries,omitempty"`
+	// FailureThreshold is the number of failures in a row that opens the breaker.
+	FailureThreshold int `json:"failure_threshold,omitempty"`
+	// OpenFor is how long an open breaker fails calls before letting one through.
+	OpenFor Duration `json:"open_for,omitempty"`
+
+	breaker *Breaker
+}
+
+func (d *Downstream) prepare() error {
+	if d.Timeout <= 0 {
+		d.Timeout = Duration(defaultActionTimeout)
+	}
+	if d.Retries < 0 {
+		d.Retries = 0
+	}
+	if d.FailureThreshold <= 0 {
+		d.FailureThreshold = defaultFailureThreshold
+	}
+	if d.OpenFor <= 0 {
+		d.OpenFor = Duration(defaultOpenFor)
+	}
+	d.breaker = &Breaker{name: d.Name, threshold: d.FailureThreshold, openFor: time.Duration(d.OpenFor)}
+	return nil
+}
+
+// Breaker is a circuit breaker. After too many failures in a row it opens and fails
+// calls right away; once OpenFor has passed a single call is let through, and its
+// outcome closes the breaker or opens it again.
+type Breaker struct {
+	name      string
+	threshold int
+	openFor   time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// BreakerState is a snapshot of a breaker, as shown on /admin/breakers.
+type BreakerState struct {
+	Downstream string     `json:"downstream"`
+	State      string     `json:"state"`
+	Failures   int        `json:"failures"`
+	OpenedAt   *time.Time `json:"opened_at,omitempty"`
+	RetryAt    *time.Time `json:"retry_at,omitempty"`
+}
+
+// Allow reports whether a call may be made. When it may not, it returns how long
+// the breaker stays open.
+func (b *Breaker) Allow() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.current() {
+	case BreakerOpen:
+		return time.Until(b.openedAt.Add(b.openFor)), false
+	case BreakerHalfOpen:
+		if b.probing {
+			return b.openFor, false
+		}
+		b.probing = true
+	}
+	return 0, true
+}
+
+// Success records a call the downstream answered.
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.current() == BreakerHalfOpen {
+		log.Printf("circuit to %s closed", b.name)
+	}
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure records a call that failed or timed out.
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.current() == BreakerHalfOpen || b.failures >= b.threshold {
+		if b.state != BreakerOpen || b.probing {
+			log.Printf("circuit to %s opened after %d failures", b.name, b.failures)
+		}
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+	b.probing = false
+}
+
+// Release gives up a call without an outcome, such as one the client cancelled.
+func (b *Breaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// State returns a snapshot of the breaker.
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := BreakerState{Downstream: b.name, State: b.current(), Failures: b.failures}
+	if s.State != BreakerClosed {
+		openedAt, retryAt := b.openedAt, b.openedAt.Add(b.openFor)
+		s.OpenedAt, s.RetryAt = &openedAt, &retryAt
+	}
+	return s
+}
+
+// current returns the state, turning open into half-open once OpenFor has passed.
+func (b *Breaker) current() string {
+	if b.state == "" {
+		return BreakerClosed
+	}
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.openFor {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// retryDelay is the pause before retry n (starting at 0): exponential backoff with
+// full jitter, so clients retrying together do not hit the downstream at once.
+func retryDelay(n int) time.Duration {
+	d := retryBaseDelay << n
+	if d <= 0 || d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+// sleep waits for d, or less when ctx is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
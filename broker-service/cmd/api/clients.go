@@ -0,0 +1,209 @@
+package main
+
+import (
+	"broker/event"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"time"
+	"toolbox/tracing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Clients are the long-lived connections to the downstream services, created once at
+// startup and shared by all requests.
+type Clients struct {
+	// HTTP shares one transport, so connections to each service are kept alive.
+	HTTP *http.Client
+	// Emitter publishes over a pool of AMQP channels.
+	Emitter *event.Emitter
+
+	rpcPoolSize int
+
+	mu   sync.Mutex
+	rpc  map[string]*RPCPool
+	grpc map[string]*grpc.ClientConn
+}
+
+// NewClients sets up the shared clients. rpcPoolSize is the number of connections kept
+// to each RPC target.
+func NewClients(conn *amqp.Connection, rpcPoolSize int) (*Clients, error) {
+	c := &Clients{
+		HTTP: &http.Client{
+			Transport: tracing.Transport(&http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				DialContext:         (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+				MaxIdleConns:        256,
+				MaxIdleConnsPerHost: 64,
+				IdleConnTimeout:     90 * time.Second,
+			}),
+		},
+		rpcPoolSize: rpcPoolSize,
+		rpc:         make(map[string]*RPCPool),
+		grpc:        make(map[string]*grpc.ClientConn),
+	}
+	if conn != nil {
+		emitter, err := event.NewEventEmitter(conn)
+		if err != nil {
+			return nil, err
+		}
+		c.Emitter = &emitter
+	}
+	return c, nil
+}
+
+// RPC returns the connection pool for addr.
+func (c *Clients) RPC(addr string) *RPCPool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pool, ok := c.rpc[addr]
+	if !ok {
+		pool = NewRPCPool(addr, c.rpcPoolSize)
+		c.rpc[addr] = pool
+	}
+	return pool
+}
+
+// GRPC returns the connection for target. A ClientConn multiplexes calls and
+// reconnects by itself, so one per target is enough.
+func (c *Clients) GRPC(target string) (*grpc.ClientConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	conn, ok := c.grpc[target]
+	if !ok {
+		var err error
+		conn, err = grpc.Dial(target,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithUnaryInterceptor(tracing.UnaryClientInterceptor()),
+		)
+		if err != nil {
+			return nil, err
+		}
+		c.grpc[target] = conn
+	}
+	return conn, nil
+}
+
+// Close shuts down all connections.
+func (c *Clients) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, pool := range c.rpc {
+		pool.Close()
+	}
+	for _, conn := range c.grpc {
+		conn.Close()
+	}
+	if c.Emitter != nil {
+		c.Emitter.Close()
+	}
+	c.HTTP.CloseIdleConnections()
+}
+
+// RPCPool spreads calls over a fixed number of net/rpc connections to one address.
+// Connections are dialed on first use and replaced when they break.
+type RPCPool struct {
+	addr string
+
+	mu      sync.Mutex
+	clients []*rpc.Client
+	next    int
+}
+
+func NewRPCPool(addr string, size int) *RPCPool {
+	if size < 1 {
+		size = 1
+	}
+	return &RPCPool{addr: addr, clients: make([]*rpc.Client, size)}
+}
+
+// Call invokes method and waits for its reply until ctx is done. When the connection
+// turns out to be closed already, nothing was sent and the call is made once more on
+// a new connection.
+func (p *RPCPool) Call(ctx context.Context, method string, args any, reply any) error {
+	err := p.call(ctx, method, args, reply)
+	if errors.Is(err, rpc.ErrShutdown) {
+		err = p.call(ctx, method, args, reply)
+	}
+	return err
+}
+
+func (p *RPCPool) call(ctx context.Context, method string, args any, reply any) error {
+	slot, client, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if isBrokenConn(call.Error) {
+		p.discard(slot, client)
+	}
+	return call.Error
+}
+
+// get returns the next client in turn, dialing it if needed.
+func (p *RPCPool) get(ctx context.Context) (int, *rpc.Client, error) {
+	p.mu.Lock()
+	slot := p.next
+	p.next = (p.next + 1) % len(p.clients)
+	client := p.clients[slot]
+	p.mu.Unlock()
+	if client != nil {
+		return slot, client, nil
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return slot, nil, err
+	}
+	client = rpc.NewClient(conn)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if existing := p.clients[slot]; existing != nil {
+		// someone else connected this slot meanwhile
+		client.Close()
+		return slot, existing, nil
+	}
+	p.clients[slot] = client
+	return slot, client, nil
+}
+
+func (p *RPCPool) discard(slot int, client *rpc.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.clients[slot] == client {
+		p.clients[slot] = nil
+	}
+	client.Close()
+}
+
+// Close closes every connection of the pool.
+func (p *RPCPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, client := range p.clients {
+		if client != nil {
+			client.Close()
+			p.clients[i] = nil
+		}
+	}
+}
+
+func isBrokenConn(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || (errors.As(err, &netErr) && !netErr.Timeout())
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"testing"
+)
+
+// EchoServer answers RPC calls with their argument.
+type EchoServer struct{}
+
+func (EchoServer) Echo(args string, reply *string) error {
+	*reply = args
+	return nil
+}
+
+func newRPCServer(b *testing.B) string {
+	b.Helper()
+	server := rpc.NewServer()
+	if err := server.Register(EchoServer{}); err != nil {
+		b.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { ln.Close() })
+	go server.Accept(ln)
+	return ln.Addr().String()
+}
+
+// BenchmarkCallRPC compares calls over the pool with dialing a connection per call,
+// as the broker did before the pool.
+func BenchmarkCallRPC(b *testing.B) {
+	addr := newRPCServer(b)
+
+	b.Run("pooled", func(b *testing.B) {
+		pool := NewRPCPool(addr, 4)
+		defer pool.Close()
+		b.RunParallel(func(pb *testing.PB) {
+			var reply string
+			for pb.Next() {
+				if err := pool.Call(context.Background(), "EchoServer.Echo", "ping", &reply); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+
+	b.Run("dial per call", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			var reply string
+			for pb.Next() {
+				client, err := rpc.Dial("tcp", addr)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				err = client.Call("EchoServer.Echo", "ping", &reply)
+				client.Close()
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkCallHTTP compares the shared keep-alive transport of the broker with a new
+// client per call.
+func BenchmarkCallHTTP(b *testing.B) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte(`{"error": false, "message": "ok"}`))
+	}))
+	defer srv.Close()
+
+	get := func(b *testing.B, client *http.Client) bool {
+		res, err := client.Get(srv.URL)
+		if err != nil {
+			b.Error(err)
+			return false
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		return true
+	}
+
+	b.Run("shared transport", func(b *testing.B) {
+		clients, err := NewClients(nil, 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer clients.Close()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if !get(b, clients.HTTP) {
+					return
+				}
+			}
+		})
+	})
+
+	b.Run("client per call", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				transport := &http.Transport{}
+				ok := get(b, &http.Client{Transport: transport})
+				transport.CloseIdleConnections()
+				if !ok {
+					return
+				}
+			}
+		})
+	})
+}
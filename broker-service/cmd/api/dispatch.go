@@ -0,0 +1,475 @@
+package main
+
+import (
+	_ "broker/logs" // registers the logger-service descriptors for grpc actions
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+	"toolbox/jsonutil"
+	"toolbox/tracing"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// actionResult is the answer of an action, ready to be written to the client.
+type actionResult struct {
+	Status int               `json:"status"`
+	Header http.Header       `json:"header,omitempty"`
+	Body   jsonutil.Response `json:"body"`
+	// Fields lists the invalid fields of a rejected payload.
+	Fields []jsonutil.FieldError `json:"fields,omitempty"`
+}
+
+func resultOK(status int, message string, data any) actionResult {
+	return actionResult{Status: status, Body: jsonutil.Response{Error: false, Message: message, Data: data}}
+}
+
+func resultError(status int, err error) actionResult {
+	res := actionResult{Status: status, Body: jsonutil.Response{Error: true, Message: err.Error()}}
+	var invalid *jsonutil.Error
+	if errors.As(err, &invalid) {
+		res.Fields = invalid.Fields
+	}
+	return res
+}
+
+func (res actionResult) failed() bool {
+	return res.Body.Error || res.Status < 200 || res.Status > 299
+}
+
+// writeResult sends the result to the client, as problem details if it failed.
+func (app *Config) writeResult(w http.ResponseWriter, res actionResult) {
+	if res.failed() {
+		status := res.Status
+		if status < 400 {
+			// a downstream service said it failed while answering with success
+			status = http.StatusBadGateway
+		}
+		err := jsonutil.NewError(status, "", res.Body.Message)
+		err.Fields = res.Fields
+		app.JSON.WriteProblem(w, jsonutil.ProblemFor(err), res.Header)
+		return
+	}
+	app.JSON.WriteJSON(w, res.Status, res.Body, res.Header)
+}
+
+// callAction runs the action name for the typed APIs just like /handle would, and
+// returns the message and data of its answer as plain JSON values. A failed action
+// is returned as an actionError.
+func (app *Config) callAction(r *http.Request, auth *authorization, name, transport string, payload any) (map[string]any, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	request := map[string]json.RawMessage{"payload": body}
+	request["action"], _ = json.Marshal(name)
+	if transport != "" {
+		request["transport"], _ = json.Marshal(transport)
+	}
+
+	res := app.dispatch(r, request, "", auth)
+	if res.failed() {
+		return nil, actionError{res}
+	}
+	return plainAnswer(res)
+}
+
+// plainAnswer turns the answer of an action into maps and slices.
+func plainAnswer(res actionResult) (map[string]any, error) {
+	b, err := json.Marshal(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	var answer map[string]any
+	err = json.Unmarshal(b, &answer)
+	return answer, err
+}
+
+// answerData returns the data of an answer as an object.
+func answerData(answer map[string]any) map[string]any {
+	data, _ := answer["data"].(map[string]any)
+	return data
+}
+
+// actionError is a failed action returned as an error, keeping its HTTP status.
+type actionError struct {
+	res actionResult
+}
+
+func (e actionError) Error() string {
+	return e.res.Body.Message
+}
+
+// runAction validates payload and calls the target of the action over its transport.
+func (app *Config) runAction(ctx context.Context, a *Action, payload json.RawMessage) actionResult {
+	if err := a.Validate(payload); err != nil {
+		return resultError(err.Status, err)
+	}
+
+	res := app.callDownstream(ctx, a, payload)
+	if !res.failed() && a.Message != "" {
+		res.Body.Message = a.Message
+	}
+	if !res.failed() && a.selectable {
+		// clients choosing a transport get the same answer whichever they choose
+		data := map[string]string{"transport": a.Transport}
+		if tracking, ok := res.Body.Data.(map[string]string); ok && tracking["id"] != "" {
+			data["id"] = tracking["id"]
+		}
+		res.Status = http.StatusAccepted
+		res.Body.Data = data
+	}
+	return res
+}
+
+// callDownstream makes the call through the circuit breaker of the downstream of the
+// action. Idempotent actions are tried again, after a growing random pause, when the
+// downstream failed or timed out.
+func (app *Config) callDownstream(ctx context.Context, a *Action, payload json.RawMessage) actionResult {
+	var id string
+	if a.Transport == TransportAMQP {
+		// every attempt publishes the same message, under the same tracking ID
+		var err *jsonutil.Error
+		if id, payload, err = trackMessage(a, payload); err != nil {
+			return resultError(err.Status, err)
+		}
+	}
+
+	d := a.downstream
+	if d == nil {
+		return app.attempt(ctx, a, payload, id)
+	}
+	retries := 0
+	if a.Idempotent {
+		retries = d.Retries
+	}
+
+	var res actionResult
+	for n := 0; ; n++ {
+		wait, ok := d.breaker.Allow()
+		if !ok {
+			if n > 0 {
+				return res
+			}
+			return circuitOpen(d, wait)
+		}
+
+		res = app.attempt(ctx, a, payload, id)
+		switch {
+		case ctx.Err() != nil:
+			// the client gave up, which says nothing about the downstream
+			d.breaker.Release()
+			return res
+		case res.Status != http.StatusBadGateway && res.Status != http.StatusGatewayTimeout:
+			d.breaker.Success()
+			return res
+		}
+		d.breaker.Failure()
+
+		if n >= retries || sleep(ctx, retryDelay(n)) != nil {
+			return res
+		}
+	}
+}
+
+// attempt calls the target of the action once, within the timeout of the action. id is
+// the tracking ID of the message published by an AMQP action.
+func (app *Config) attempt(ctx context.Context, a *Action, payload json.RawMessage, id string) actionResult {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(a.Timeout))
+	defer cancel()
+
+	switch a.Transport {
+	case TransportHTTP:
+		return app.callHTTP(ctx, a, payload)
+	case TransportRPC:
+		return app.callRPC(ctx, a, payload)
+	case TransportGRPC:
+		return app.callGRPC(ctx, a, payload)
+	default:
+		return app.callAMQP(ctx, a, payload, id)
+	}
+}
+
+// callFailed is the result of a call that got no answer: a timeout when ctx is done,
+// otherwise a bad gateway.
+func callFailed(ctx context.Context, a *Action, err error) actionResult {
+	if ctx.Err() != nil {
+		return resultError(http.StatusGatewayTimeout, fmt.Errorf("error calling %s: %w", a.Name, ctx.Err()))
+	}
+	return resultError(http.StatusBadGateway, fmt.Errorf("error calling %s: %w", a.Name, err))
+}
+
+func circuitOpen(d *Downstream, wait time.Duration) actionResult {
+	res := resultError(http.StatusServiceUnavailable, fmt.Errorf("%s is unavailable, try again later", d.Name))
+	res.Header = http.Header{}
+	res.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return res
+}
+
+// callHTTP sends payload to the target URL. The downstream services answer with the
+// same JSON envelope as the broker, so their message and data are passed on.
+func (app *Config) callHTTP(ctx context.Context, a *Action, payload json.RawMessage) actionResult {
+	var request *http.Request
+	var err error
+	if a.Method == http.MethodGet {
+		// GET requests have no body, their payload goes into the query string
+		target := a.Target
+		query, queryErr := queryString(payload)
+		if queryErr != nil {
+			return resultError(http.StatusBadRequest, queryErr)
+		}
+		if query != "" {
+			target += "?" + query
+		}
+		request, err = http.NewRequestWithContext(ctx, a.Method, target, nil)
+	} else {
+		request, err = http.NewRequestWithContext(ctx, a.Method, a.Target, bytes.NewReader(payload))
+	}
+	if err != nil {
+		return resultError(http.StatusInternalServerError, err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := app.Clients.HTTP.Do(request)
+	if err != nil {
+		return callFailed(ctx, a, err)
+	}
+	defer response.Body.Close()
+
+	var downstream struct {
+		jsonutil.Response
+		// Errors are the invalid fields listed by problem details answers.
+		Errors []jsonutil.FieldError `json:"errors"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 10<<20))
+	decodeErr := json.Unmarshal(body, &downstream)
+
+	switch {
+	case response.StatusCode >= 500:
+		return resultError(http.StatusBadGateway, fmt.Errorf("error calling %s", a.Name))
+	case response.StatusCode >= 400:
+		// client errors such as bad input, bad credentials or throttling are the
+		// client's to fix, so they are passed on as they are
+		message := downstream.Message
+		if decodeErr != nil || message == "" {
+			message = http.StatusText(response.StatusCode)
+		}
+		res := resultError(response.StatusCode, errors.New(message))
+		res.Fields = downstream.Errors
+		if retry := response.Header.Get("Retry-After"); retry != "" {
+			res.Header = http.Header{}
+			res.Header.Set("Retry-After", retry)
+		}
+		return res
+	case decodeErr != nil:
+		return resultError(http.StatusBadGateway, fmt.Errorf("invalid answer from %s: %w", a.Name, decodeErr))
+	case downstream.Error:
+		return resultError(http.StatusBadRequest, errors.New(downstream.Message))
+	}
+	return resultOK(response.StatusCode, downstream.Message, downstream.Data)
+}
+
+// queryString encodes the fields of a JSON object payload as URL query parameters.
+func queryString(payload json.RawMessage) (string, error) {
+	if len(bytes.TrimSpace(payload)) == 0 {
+		return "", nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return "", errors.New("payload must be a JSON object")
+	}
+	query := url.Values{}
+	for name, value := range fields {
+		switch jsonKind(value) {
+		case "null":
+		case "string":
+			var s string
+			json.Unmarshal(value, &s)
+			query.Set(name, s)
+		default:
+			query.Set(name, string(bytes.TrimSpace(value)))
+		}
+	}
+	return query.Encode(), nil
+}
+
+// callRPC calls a net/rpc method with the payload converted to the struct built from
+// the action schema. The method answers with a string.
+func (app *Config) callRPC(ctx context.Context, a *Action, payload json.RawMessage) actionResult {
+	args := reflect.New(a.rpcArgs)
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, args.Interface()); err != nil {
+			return resultError(http.StatusBadRequest, err)
+		}
+	}
+
+	ctx, span, traceContext := tracing.StartRPCClient(ctx, a.Method)
+	args.Elem().FieldByName(rpcTraceField).Set(reflect.ValueOf(traceContext))
+
+	var result string
+	err := app.Clients.RPC(a.Target).Call(ctx, a.Method, args.Elem().Interface(), &result)
+	tracing.End(span, err)
+	if err != nil {
+		return callFailed(ctx, a, err)
+	}
+	return resultOK(http.StatusAccepted, result, nil)
+}
+
+// callGRPC invokes a unary gRPC method. Request and response messages are built from
+// the registered descriptors, so any service compiled into the broker can be used.
+func (app *Config) callGRPC(ctx context.Context, a *Action, payload json.RawMessage) actionResult {
+	if a.RequestField != "" {
+		payload, _ = json.Marshal(map[string]json.RawMessage{a.RequestField: payload})
+	}
+	request := dynamicpb.NewMessage(a.grpcMethod.Input())
+	if err := protojson.Unmarshal(payload, request); err != nil {
+		return resultError(http.StatusBadRequest, err)
+	}
+	response := dynamicpb.NewMessage(a.grpcMethod.Output())
+
+	conn, err := app.Clients.GRPC(a.Target)
+	if err != nil {
+		return resultError(http.StatusBadGateway, fmt.Errorf("error calling %s: %w", a.Name, err))
+	}
+
+	method := fmt.Sprintf("/%s/%s", a.grpcMethod.Parent().FullName(), a.grpcMethod.Name())
+	if err := conn.Invoke(ctx, method, request, response); err != nil {
+		return callFailed(ctx, a, err)
+	}
+
+	data, err := protojson.Marshal(response)
+	if err != nil {
+		return resultError(http.StatusBadGateway, err)
+	}
+	return resultOK(http.StatusAccepted, "done", json.RawMessage(data))
+}
+
+// trackMessage picks the tracking ID of a message published by an AMQP action and, when
+// the action has an IDField, writes the ID into that field of payload.
+func trackMessage(a *Action, payload json.RawMessage) (string, json.RawMessage, *jsonutil.Error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, jsonutil.NewError(http.StatusInternalServerError, "", err.Error())
+	}
+	id := hex.EncodeToString(b)
+	if a.IDField == "" {
+		return id, payload, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &fields); err != nil {
+			return "", nil, jsonutil.NewError(http.StatusBadRequest, "", err.Error())
+		}
+	}
+	if fields == nil {
+		fields = make(map[string]json.RawMessage)
+	}
+	fields[a.IDField], _ = json.Marshal(id)
+	payload, _ = json.Marshal(fields)
+	return id, payload, nil
+}
+
+// callAMQP publishes payload on the routing key of the action and answers right away
+// with a tracking ID, which is also the message ID of the event.
+func (app *Config) callAMQP(ctx context.Context, a *Action, payload json.RawMessage, id string) actionResult {
+	if app.Clients.Emitter == nil {
+		return resultError(http.StatusServiceUnavailable, errors.New("not connected to RabbitMQ"))
+	}
+	err := app.Clients.Emitter.PushJSON(ctx, payload, a.Target, id)
+	if err != nil {
+		return resultError(http.StatusBadGateway, fmt.Errorf("error publishing %s: %w", a.Name, err))
+	}
+	return resultOK(http.StatusAccepted, "queued", map[string]string{"id": id, "status": "pending"})
+}
+
+// authorize checks the Basic credentials of r with the authenticator action. On success
+// it returns the answer of the authenticator, which describes the user.
+func (app *Config) authorize(r *http.Request) (actionResult, bool) {
+	email, password, ok := r.BasicAuth()
+	if !ok {
+		return unauthorized("authentication required"), false
+	}
+
+	auth, _ := app.Actions.Get(app.Actions.Authenticator)
+	credentials, _ := json.Marshal(map[string]string{"email": email, "password": password})
+	res := app.runAction(r.Context(), auth, credentials)
+	switch {
+	case res.Status >= 500:
+		return res, false
+	case res.failed():
+		return unauthorized("invalid credentials"), false
+	}
+	return res, true
+}
+
+// authorization checks the Basic credentials of a request with the authenticator
+// action, only once however many actions of the request need them.
+type authorization struct {
+	app  *Config
+	r    *http.Request
+	mu   sync.Mutex
+	done bool
+	res  actionResult
+	ok   bool
+}
+
+// authorizeOnce returns the authorization of r, for dispatch.
+func (app *Config) authorizeOnce(r *http.Request) *authorization {
+	return &authorization{app: app, r: r}
+}
+
+// check checks the credentials the first time and returns the same answer afterwards.
+// Wrong credentials count against the rate limit of the authenticator action for the
+// client, so passwords cannot be guessed faster through the actions requiring them.
+func (a *authorization) check() (actionResult, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.done {
+		return a.res, a.ok
+	}
+	a.done = true
+
+	auth, _ := a.app.Actions.Get(a.app.Actions.Authenticator)
+	if res, ok := a.app.RateLimiter.AllowAuthentication(a.r, auth); !ok {
+		a.res = res
+		return a.res, a.ok
+	}
+	a.res, a.ok = a.app.authorize(a.r)
+	if _, _, sent := a.r.BasicAuth(); sent && a.res.Status == http.StatusUnauthorized {
+		a.app.RateLimiter.AuthenticationFailed(a.r, auth)
+	}
+	return a.res, a.ok
+}
+
+// user is the email of the client once check has accepted its credentials. It never
+// checks them itself.
+func (a *authorization) user() (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.done || !a.ok {
+		return "", false
+	}
+	email, _, _ := a.r.BasicAuth()
+	return email, true
+}
+
+func unauthorized(message string) actionResult {
+	res := resultError(http.StatusUnauthorized, errors.New(message))
+	res.Header = http.Header{}
+	res.Header.Set("WWW-Authenticate", `Basic realm="broker"`)
+	return res
+}
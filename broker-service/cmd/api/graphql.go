@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+const (
+	// defaultGraphQLMaxDepth is used when BROKER_GRAPHQL_MAX_DEPTH is not set.
+	defaultGraphQLMaxDepth = 8
+	// graphQLMaxIntrospectionDepth bounds introspection queries, which nest deeper
+	// than the data: tools unwrap types through several levels of ofType.
+	graphQLMaxIntrospectionDepth = 15
+)
+
+// graphQLRequest is the body of /graphql.
+type graphQLRequest struct {
+	Query         string         `json:"query"`
+	Variables     map[string]any `json:"variables"`
+	OperationName string         `json:"operationName"`
+}
+
+type graphQLContextKey struct{}
+
+// graphQLContext is what resolvers need to know about the HTTP request.
+type graphQLContext struct {
+	r    *http.Request
+	auth *authorization
+}
+
+// Extensions adds the HTTP status the action would have had on /handle to GraphQL
+// errors, and the invalid fields of a rejected payload.
+func (e actionError) Extensions() map[string]any {
+	ext := map[string]any{"status": e.res.Status}
+	if retry := e.res.Header.Get("Retry-After"); retry != "" {
+		ext["retry_after"] = retry
+	}
+	if len(e.res.Fields) > 0 {
+		ext["fields"] = e.res.Fields
+	}
+	return ext
+}
+
+// GraphQL executes a GraphQL query. The fields resolve to the same actions as /handle.
+func (app *Config) GraphQL(w http.ResponseWriter, r *http.Request) {
+	// clients may send members of their own, such as "extensions"
+	tools := app.JSON
+	tools.AllowUnknownFields = true
+
+	var request graphQLRequest
+	err := tools.ReadJSON(w, r, &request)
+	if err != nil {
+		tools.ErrorJSON(w, err)
+		return
+	}
+
+	doc, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{Body: []byte(request.Query), Name: "GraphQL request"})})
+	if err != nil {
+		app.JSON.WriteJSON(w, http.StatusBadRequest, graphql.Result{Errors: gqlerrors.FormatErrors(err)})
+		return
+	}
+	depth, err := queryDepth(doc)
+	switch {
+	case err != nil:
+	case depth.data > app.GraphQLMaxDepth:
+		err = fmt.Errorf("query is %d levels deep, at most %d are allowed", depth.data, app.GraphQLMaxDepth)
+	case depth.introspection > graphQLMaxIntrospectionDepth:
+		err = fmt.Errorf("introspection is %d levels deep, at most %d are allowed", depth.introspection, graphQLMaxIntrospectionDepth)
+	}
+	if err != nil {
+		app.JSON.WriteJSON(w, http.StatusBadRequest, graphql.Result{Errors: gqlerrors.FormatErrors(err)})
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), graphQLContextKey{}, &graphQLContext{r: r, auth: app.authorizeOnce(r)})
+	result := graphql.Do(graphql.Params{
+		Schema:         *app.GraphQLSchema,
+		RequestString:  request.Query,
+		VariableValues: request.Variables,
+		OperationName:  request.OperationName,
+		Context:        ctx,
+	})
+	app.JSON.WriteJSON(w, http.StatusOK, result)
+}
+
+// queryDepth returns how deeply the fields of the deepest operation in doc are nested.
+// Fields below introspection fields are measured apart, so tools can read the schema
+// without raising the limit for data. Fragments spreading themselves are an error;
+// they are caught here, before the validation of graphql-go recurses into them
+// without end.
+func queryDepth(doc *ast.Document) (depth, error) {
+	fragments := make(map[string]*ast.FragmentDefinition)
+	for _, def := range doc.Definitions {
+		if f, ok := def.(*ast.FragmentDefinition); ok {
+			fragments[f.Name.Value] = f
+		}
+	}
+	d := depthWalker{fragments: fragments, depths: make(map[string]depth), visiting: make(map[string]bool)}
+
+	var deepest depth
+	for _, def := range doc.Definitions {
+		var op depth
+		var err error
+		switch def := def.(type) {
+		case *ast.OperationDefinition:
+			op, err = d.selections(def.SelectionSet)
+		case *ast.FragmentDefinition:
+			// unused fragments are checked for cycles as well
+			_, err = d.fragment(def.Name.Value)
+		}
+		if err != nil {
+			return depth{}, err
+		}
+		deepest = deepest.deepest(op)
+	}
+	return deepest, nil
+}
+
+// depth is how deeply fields are nested. Paths through an introspection field, such
+// as __schema or __type, count towards introspection only.
+type depth struct {
+	data          int
+	introspection int
+}
+
+func (d depth) deepest(other depth) depth {
+	return depth{data: max(d.data, other.data), introspection: max(d.introspection, other.introspection)}
+}
+
+// below is the depth of a field whose selection set has depth d.
+func (d depth) below(field *ast.Field) depth {
+	if strings.HasPrefix(field.Name.Value, "__") {
+		return depth{introspection: max(d.data, d.introspection) + 1}
+	}
+	below := depth{data: d.data + 1}
+	if d.introspection > 0 {
+		below.introspection = d.introspection + 1
+	}
+	return below
+}
+
+// depthWalker measures selection sets. The depth of each fragment is only worked out
+// once.
+type depthWalker struct {
+	fragments map[string]*ast.FragmentDefinition
+	depths    map[string]depth
+	visiting  map[string]bool
+}
+
+func (d depthWalker) selections(set *ast.SelectionSet) (depth, error) {
+	var deepest depth
+	if set == nil {
+		return deepest, nil
+	}
+	for _, selection := range set.Selections {
+		var sel depth
+		var err error
+		switch s := selection.(type) {
+		case *ast.Field:
+			sel, err = d.selections(s.SelectionSet)
+			sel = sel.below(s)
+		case *ast.InlineFragment:
+			sel, err = d.selections(s.SelectionSet)
+		case *ast.FragmentSpread:
+			sel, err = d.fragment(s.Name.Value)
+		}
+		if err != nil {
+			return depth{}, err
+		}
+		deepest = deepest.deepest(sel)
+	}
+	return deepest, nil
+}
+
+func (d depthWalker) fragment(name string) (depth, error) {
+	if fd, ok := d.depths[name]; ok {
+		return fd, nil
+	}
+	if d.visiting[name] {
+		return depth{}, fmt.Errorf("fragment %s spreads itself", name)
+	}
+	f, ok := d.fragments[name]
+	if !ok {
+		// unknown fragments are reported by the validation
+		return depth{}, nil
+	}
+	d.visiting[name] = true
+	fd, err := d.selections(f.SelectionSet)
+	delete(d.visiting, name)
+	d.depths[name] = fd
+	return fd, err
+}
+
+// resolveAction runs an action for a resolver just like /handle would.
+func (app *Config) resolveAction(p graphql.ResolveParams, name, transport string, payload any) (map[string]any, error) {
+	gc := p.Context.Value(graphQLContextKey{}).(*graphQLContext)
+	return app.callAction(gc.r.WithContext(p.Context), gc.auth, name, transport, payload)
+}
+
+// key resolves a field from a differently named key of a JSON object.
+func key(name string) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (any, error) {
+		if m, ok := p.Source.(map[string]any); ok {
+			return m[name], nil
+		}
+		return nil, nil
+	}
+}
+
+// inputPayload copies the arguments in args into a payload, renaming them as in names.
+func inputPayload(args map[string]any, names map[string]string) map[string]any {
+	payload := make(map[string]any, len(args))
+	for arg, value := range args {
+		if name, ok := names[arg]; ok {
+			arg = name
+		}
+		payload[arg] = value
+	}
+	return payload
+}
+
+// jsonScalar holds any JSON value, for the free-form parts of a payload such as
+// template data and mail headers.
+var jsonScalar = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "JSON",
+	Description: "Any JSON value.",
+	Serialize:   func(value any) any { return value },
+	ParseValue:  func(value any) any { return value },
+	ParseLiteral: func(value ast.Value) any {
+		return literalValue(value)
+	},
+})
+
+func literalValue(value ast.Value) any {
+	switch v := value.(type) {
+	case *ast.StringValue:
+		return v.Value
+	case *ast.EnumValue:
+		return v.Value
+	case *ast.BooleanValue:
+		return v.Value
+	case *ast.IntValue:
+		n, _ := strconv.ParseInt(v.Value, 10, 64)
+		return n
+	case *ast.FloatValue:
+		n, _ := strconv.ParseFloat(v.Value, 64)
+		return n
+	case *ast.ListValue:
+		list := make([]any, 0, len(v.Values))
+		for _, item := range v.Values {
+			list = append(list, literalValue(item))
+		}
+		return list
+	case *ast.ObjectValue:
+		object := make(map[string]any, len(v.Fields))
+		for _, field := range v.Fields {
+			object[field.Name.Value] = literalValue(field.Value)
+		}
+		return object
+	}
+	return nil
+}
+
+// graphQLSchema builds the schema served on /graphql.
+func (app *Config) graphQLSchema() (*graphql.Schema, error) {
+	userType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"id":        &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"email":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"firstName": &graphql.Field{Type: graphql.String, Resolve: key("first_name")},
+			"lastName":  &graphql.Field{Type: graphql.String, Resolve: key("last_name")},
+			"active": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					active, _ := p.Source.(map[string]any)["active"].(float64)
+					return active != 0, nil
+				},
+			},
+			"createdAt": &graphql.Field{Type: graphql.String, Resolve: key("created_at")},
+			"updatedAt": &graphql.Field{Type: graphql.String, Resolve: key("updated_at")},
+		},
+	})
+
+	logEntryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "LogEntry",
+		Fields: graphql.Fields{
+			"id":        &graphql.Field{Type: graphql.ID},
+			"name":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"data":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"createdAt": &graphql.Field{Type: graphql.String, Resolve: key("created_at")},
+			"updatedAt": &graphql.Field{Type: graphql.String, Resolve: key("updated_at")},
+		},
+	})
+
+	transportType := graphql.NewEnum(graphql.EnumConfig{
+		Name: "Transport",
+		Values: graphql.EnumValueConfigMap{
+			"HTTP": &graphql.EnumValueConfig{Value: TransportHTTP},
+			"RPC":  &graphql.EnumValueConfig{Value: TransportRPC},
+			"GRPC": &graphql.EnumValueConfig{Value: TransportGRPC},
+			"AMQP": &graphql.EnumValueConfig{Value: TransportAMQP},
+		},
+	})
+
+	authResultType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "AuthResult",
+		Fields: graphql.Fields{
+			"message": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"user":    &graphql.Field{Type: userType, Resolve: key("data")},
+		},
+	})
+
+	logResultType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "LogResult",
+		Fields: graphql.Fields{
+			"message":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"transport": &graphql.Field{Type: transportType},
+			"id":        &graphql.Field{Type: graphql.ID, Description: "Tracking ID of logs sent via AMQP."},
+		},
+	})
+
+	mailResultType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "MailResult",
+		Fields: graphql.Fields{
+			"message": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"id":      &graphql.Field{Type: graphql.ID, Description: "Tracking ID, for /mail/{id}."},
+			"status":  &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	addresses := graphql.NewList(graphql.NewNonNull(graphql.String))
+	mailInputType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "MailInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"from":       &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"to":         &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(addresses)},
+			"cc":         &graphql.InputObjectFieldConfig{Type: addresses},
+			"bcc":        &graphql.InputObjectFieldConfig{Type: addresses},
+			"replyTo":    &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"headers":    &graphql.InputObjectFieldConfig{Type: jsonScalar},
+			"subject":    &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"subjectKey": &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "Key of a translated subject, subject is sent as it is."},
+			"message":    &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"template":   &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"locale":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"data":       &graphql.InputObjectFieldConfig{Type: jsonScalar, Description: "Template data."},
+			"sendAt":     &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"timezone":   &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"me": &graphql.Field{
+				Type:        graphql.NewNonNull(userType),
+				Description: "The user whose Basic credentials were sent with the request.",
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					gc := p.Context.Value(graphQLContextKey{}).(*graphQLContext)
+					res, ok := gc.auth.check()
+					if !ok {
+						return nil, actionError{res}
+					}
+					answer, err := plainAnswer(res)
+					if err != nil {
+						return nil, err
+					}
+					return answerData(answer), nil
+				},
+			},
+			"logs": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(logEntryType))),
+				Description: "The latest log entries, newest first.",
+				Args: graphql.FieldConfigArgument{
+					"name":  &graphql.ArgumentConfig{Type: graphql.String},
+					"limit": &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					answer, err := app.resolveAction(p, "logs", "", p.Args)
+					if err != nil {
+						return nil, err
+					}
+					if answer["data"] == nil {
+						return []any{}, nil
+					}
+					return answer["data"], nil
+				},
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"authenticate": &graphql.Field{
+				Type: graphql.NewNonNull(authResultType),
+				Args: graphql.FieldConfigArgument{
+					"email":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"password": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return app.resolveAction(p, "auth", "", p.Args)
+				},
+			},
+			"writeLog": &graphql.Field{
+				Type: graphql.NewNonNull(logResultType),
+				Args: graphql.FieldConfigArgument{
+					"name":      &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"data":      &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"transport": &graphql.ArgumentConfig{Type: transportType},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					transport, _ := p.Args["transport"].(string)
+					answer, err := app.resolveAction(p, "log", transport, map[string]any{
+						"name": p.Args["name"],
+						"data": p.Args["data"],
+					})
+					if err != nil {
+						return nil, err
+					}
+					data := answerData(answer)
+					return map[string]any{"message": answer["message"], "transport": data["transport"], "id": data["id"]}, nil
+				},
+			},
+			"sendMail": &graphql.Field{
+				Type: graphql.NewNonNull(mailResultType),
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(mailInputType)},
+					"async": &graphql.ArgumentConfig{
+						Type:         graphql.Boolean,
+						DefaultValue: false,
+						Description:  "Queue the mail via RabbitMQ instead of handing it to the mail service directly.",
+					},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					input, _ := p.Args["input"].(map[string]any)
+					payload := inputPayload(input, map[string]string{"replyTo": "reply_to", "subjectKey": "subject_key", "sendAt": "send_at"})
+					name := "mail"
+					if async, _ := p.Args["async"].(bool); async {
+						name = "mail-async"
+					}
+					answer, err := app.resolveAction(p, name, "", payload)
+					if err != nil {
+						return nil, err
+					}
+					data := answerData(answer)
+					return map[string]any{"message": answer["message"], "id": data["id"], "status": data["status"]}, nil
+				},
+			},
+		},
+	})
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+	if err != nil {
+		return nil, errors.New("building the GraphQL schema: " + err.Error())
+	}
+	return &schema, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/testutil"
+)
+
+func TestQueryDepth(t *testing.T) {
+	nested := "__type(name: \"User\") { fields { type" + strings.Repeat(" { ofType", 20) + " { name }" + strings.Repeat(" }", 20) + " } }"
+	for _, test := range []struct {
+		query         string
+		data          int
+		introspection int
+	}{
+		{`{ me { email } }`, 2, 0},
+		{`{ me { __typename email } }`, 2, 2},
+		{`{ __schema { types { name } } }`, 0, 3},
+		{`query { ...F } fragment F on Query { me { ...G } } fragment G on User { email }`, 2, 0},
+		{"{ " + nested + " }", 0, 24},
+		{testutil.IntrospectionQuery, 0, 0},
+	} {
+		doc, err := parser.Parse(parser.ParseParams{Source: test.query})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := queryDepth(doc)
+		if err != nil {
+			t.Fatalf("%s: %v", test.query, err)
+		}
+		if test.query == testutil.IntrospectionQuery {
+			if got.data != 0 || got.introspection == 0 || got.introspection > graphQLMaxIntrospectionDepth {
+				t.Errorf("the introspection query of graphql-go measures %+v", got)
+			}
+			continue
+		}
+		if got.data != test.data || got.introspection != test.introspection {
+			t.Errorf("%s: got %+v, want data %d and introspection %d", test.query, got, test.data, test.introspection)
+		}
+	}
+}
+
+func TestQueryDepthRejectsCycles(t *testing.T) {
+	doc, err := parser.Parse(parser.ParseParams{Source: `{ ...A } fragment A on Query { ...B } fragment B on Query { ...A }`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queryDepth(doc); err == nil {
+		t.Fatal("fragments spreading each other were accepted")
+	}
+}
+
+func TestGraphQLLimitsIntrospectionDepth(t *testing.T) {
+	app := newTestApp(t, `{"actions": []}`)
+	h := app.routes()
+
+	query := func(q string) int {
+		body := strings.NewReader(`{"query": ` + strconv.Quote(q) + `}`)
+		r := httptest.NewRequest(http.MethodPost, "/graphql", body)
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := query(testutil.IntrospectionQuery); code != http.StatusOK {
+		t.Errorf("the introspection query was answered with %d", code)
+	}
+	deep := "{ __type(name: \"Query\") { fields { type" + strings.Repeat(" { ofType", 20) + " { name }" + strings.Repeat(" }", 20) + " } } }"
+	if code := query(deep); code != http.StatusBadRequest {
+		t.Errorf("a %d levels deep introspection query was answered with %d", 24, code)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"broker/broker"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"toolbox/tracing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+const gRpcPort = "50001"
+
+// BrokerServer serves the actions of /handle over gRPC, and through the gateway
+// handlers as JSON on the HTTP server.
+type BrokerServer struct {
+	broker.UnimplementedBrokerServer
+	app *Config
+}
+
+func (s *BrokerServer) Authenticate(ctx context.Context, req *broker.AuthRequest) (*broker.AuthResponse, error) {
+	answer, err := s.call(ctx, "auth", "", map[string]any{
+		"email":    req.GetEmail(),
+		"password": req.GetPassword(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := &broker.AuthResponse{Message: stringValue(answer, "message")}
+	if user := answerData(answer); user != nil {
+		id, _ := user["id"].(float64)
+		active, _ := user["active"].(float64)
+		res.User = &broker.User{
+			Id:        int64(id),
+			Email:     stringValue(user, "email"),
+			FirstName: stringValue(user, "first_name"),
+			LastName:  stringValue(user, "last_name"),
+			Active:    active != 0,
+			CreatedAt: stringValue(user, "created_at"),
+			UpdatedAt: stringValue(user, "updated_at"),
+		}
+	}
+	return res, nil
+}
+
+func (s *BrokerServer) SendMail(ctx context.Context, req *broker.MailRequest) (*broker.MailResponse, error) {
+	// unset fields are left out, the mail action only checks the fields it is sent
+	payload := map[string]any{"to": req.GetTo()}
+	for name, value := range map[string]string{
+		"from":     req.GetFrom(),
+		"reply_to": req.GetReplyTo(),
+		"subject":  req.GetSubject(),
+		"message":  req.GetMessage(),
+		"template": req.GetTemplate(),
+		"locale":   req.GetLocale(),
+		"send_at":  req.GetSendAt(),
+		"timezone": req.GetTimezone(),
+	} {
+		if value != "" {
+			payload[name] = value
+		}
+	}
+	if len(req.GetCc()) > 0 {
+		payload["cc"] = req.GetCc()
+	}
+	if len(req.GetBcc()) > 0 {
+		payload["bcc"] = req.GetBcc()
+	}
+	if len(req.GetHeaders()) > 0 {
+		payload["headers"] = req.GetHeaders()
+	}
+	if req.GetData() != nil {
+		payload["data"] = req.GetData().AsMap()
+	}
+
+	name := "mail"
+	if req.GetAsync() {
+		name = "mail-async"
+	}
+	answer, err := s.call(ctx, name, "", payload)
+	if err != nil {
+		return nil, err
+	}
+	data := answerData(answer)
+	return &broker.MailResponse{
+		Message: stringValue(answer, "message"),
+		Id:      stringValue(data, "id"),
+		Status:  stringValue(data, "status"),
+	}, nil
+}
+
+func (s *BrokerServer) WriteLog(ctx context.Context, req *broker.LogRequest) (*broker.LogResponse, error) {
+	answer, err := s.call(ctx, "log", req.GetTransport(), map[string]any{
+		"name": req.GetName(),
+		"data": req.GetData(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	data := answerData(answer)
+	return &broker.LogResponse{
+		Message:   stringValue(answer, "message"),
+		Transport: stringValue(data, "transport"),
+		Id:        stringValue(data, "id"),
+	}, nil
+}
+
+// call runs an action with the credentials found in the "authorization" metadata.
+func (s *BrokerServer) call(ctx context.Context, name, transport string, payload any) (map[string]any, error) {
+	r, err := grpcRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.app.callAction(r, s.app.authorizeOnce(r), name, transport, payload)
+}
+
+// grpcRequest is the HTTP request standing for a gRPC call, for the checks shared with
+// the HTTP server: it comes from the address of the peer, with the credentials found
+// in the "authorization" metadata.
+func grpcRequest(ctx context.Context) (*http.Request, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/", nil)
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		// clients are throttled by address like on HTTP
+		r.RemoteAddr = p.Addr.String()
+	}
+	if auth := metadataValue(ctx, "authorization"); auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+	return r, nil
+}
+
+// remoteAddr is the address of a gateway client, given to the gRPC methods as its peer.
+type remoteAddr string
+
+func (a remoteAddr) Network() string { return "tcp" }
+func (a remoteAddr) String() string  { return string(a) }
+
+func metadataValue(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func stringValue(m map[string]any, key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+// gRPCListen serves the Broker service.
+func (app *Config) gRPCListen() {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", gRpcPort))
+	if err != nil {
+		log.Fatalf("Failed to listen for gRPC: %v", err)
+	}
+	log.Printf("gRPC Server started on port %s", gRpcPort)
+
+	if err := app.gRPCServer().Serve(lis); err != nil {
+		log.Fatalf("Failed to listen for gRPC: %v", err)
+	}
+}
+
+// gRPCServer returns the server of the Broker service.
+func (app *Config) gRPCServer() *grpc.Server {
+	s := grpc.NewServer(grpc.ChainUnaryInterceptor(tracing.UnaryServerInterceptor(), actionStatus, app.grpcLimits))
+	broker.RegisterBrokerServer(s, &BrokerServer{app: app})
+	return s
+}
+
+// grpcLimits does for gRPC calls what the HTTP server does for its requests: clients
+// are throttled by IP, and calls with an "idempotency-key" in their metadata are only
+// run once per key. The rate limits of the actions are applied by the calls themselves.
+func (app *Config) grpcLimits(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	r, err := grpcRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if rl := app.RateLimiter; rl.PerIP.enabled() {
+		// a broken store must not take the broker down with it
+		if status, err := rl.take("ip:"+clientIP(r), rl.PerIP); err == nil && status.Exceeded {
+			return nil, actionError{tooManyRequests(status, "too many requests")}
+		}
+	}
+
+	key := metadataValue(ctx, "idempotency-key")
+	msg, ok := req.(proto.Message)
+	if key == "" || !ok {
+		return handler(ctx, req)
+	}
+	r.URL.Path = info.FullMethod
+	resp, err := app.idempotentCall(r, key, msg, func() (proto.Message, error) {
+		resp, err := handler(ctx, req)
+		msg, _ := resp.(proto.Message)
+		return msg, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// idempotentCall makes a call of the Broker service once per Idempotency-Key, like
+// Idempotency.Do does for /handle. Responses are kept as a packed Any, so that they
+// can be replayed whatever their type.
+func (app *Config) idempotentCall(r *http.Request, key string, req proto.Message, call func() (proto.Message, error)) (proto.Message, error) {
+	request, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp proto.Message
+	var callErr error
+	ran := false
+	res := app.Idempotency.Do(r, key, request, func() actionResult {
+		ran = true
+		resp, callErr = call()
+		var failed actionError
+		switch {
+		case errors.As(callErr, &failed):
+			return failed.res
+		case callErr != nil:
+			return resultError(http.StatusInternalServerError, callErr)
+		}
+		packed, err := anypb.New(resp)
+		if err != nil {
+			return resultError(http.StatusInternalServerError, err)
+		}
+		b, err := proto.Marshal(packed)
+		if err != nil {
+			return resultError(http.StatusInternalServerError, err)
+		}
+		return resultOK(http.StatusOK, "", b)
+	})
+	if ran {
+		return resp, callErr
+	}
+
+	// a replayed answer, or the key could not be used
+	if res.failed() {
+		return nil, actionError{res}
+	}
+	// the data was []byte when stored, and is a base64 string once read from a file
+	var b []byte
+	raw, err := json.Marshal(res.Body.Data)
+	if err == nil {
+		err = json.Unmarshal(raw, &b)
+	}
+	packed := &anypb.Any{}
+	if err == nil {
+		err = proto.Unmarshal(b, packed)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("replaying the answer: %w", err)
+	}
+	return packed.UnmarshalNew()
+}
+
+// actionStatus turns failed actions into gRPC status errors.
+func actionStatus(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	resp, err := handler(ctx, req)
+	var failed actionError
+	if errors.As(err, &failed) {
+		if retry := failed.res.Header.Get("Retry-After"); retry != "" {
+			grpc.SetHeader(ctx, metadata.Pairs("retry-after", retry))
+		}
+		return nil, grpcStatus(failed).Err()
+	}
+	return resp, err
+}
+
+// grpcStatus is the status of a failed action. The invalid fields of a rejected
+// payload are sent as BadRequest details.
+func grpcStatus(failed actionError) *status.Status {
+	st := status.New(grpcCode(failed.res.Status), failed.Error())
+	if len(failed.res.Fields) == 0 {
+		return st
+	}
+	violations := make([]*errdetails.BadRequest_FieldViolation, len(failed.res.Fields))
+	for i, f := range failed.res.Fields {
+		violations[i] = &errdetails.BadRequest_FieldViolation{Field: f.Field, Description: f.Message}
+	}
+	detailed, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if err != nil {
+		return st
+	}
+	return detailed
+}
+
+// grpcCode is the gRPC code matching an HTTP status.
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.AlreadyExists
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	return codes.Internal
+}
+
+// gatewayHandler serves a Broker method as JSON over HTTP, the way grpc-gateway maps
+// gRPC methods: the body is the request message and the answer the response message.
+// The Authorization header is passed on as metadata and the client address as the peer,
+// and calls with an Idempotency-Key are only made once per key, like on gRPC.
+func gatewayHandler[T any, Req interface {
+	*T
+	proto.Message
+}, Resp proto.Message](app *Config, call func(context.Context, Req) (Resp, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := Req(new(T))
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1048576))
+		if err == nil && len(body) > 0 {
+			err = protojson.Unmarshal(body, req)
+		}
+		if err != nil {
+			writeStatus(w, http.StatusBadRequest, status.New(codes.InvalidArgument, err.Error()), nil)
+			return
+		}
+
+		ctx := metadata.NewIncomingContext(r.Context(), metadata.Pairs("authorization", r.Header.Get("Authorization")))
+		ctx = peer.NewContext(ctx, &peer.Peer{Addr: remoteAddr(r.RemoteAddr)})
+		var resp Resp
+		if key := r.Header.Get("Idempotency-Key"); key != "" {
+			var msg proto.Message
+			msg, err = app.idempotentCall(r, key, req, func() (proto.Message, error) {
+				return call(ctx, req)
+			})
+			resp, _ = msg.(Resp)
+		} else {
+			resp, err = call(ctx, req)
+		}
+		if err != nil {
+			var failed actionError
+			if errors.As(err, &failed) {
+				writeStatus(w, failed.res.Status, grpcStatus(failed), failed.res.Header)
+				return
+			}
+			writeStatus(w, http.StatusInternalServerError, status.New(codes.Internal, err.Error()), nil)
+			return
+		}
+
+		out, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(resp)
+		if err != nil {
+			app.JSON.ErrorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(out)
+	}
+}
+
+// writeStatus answers a failed gateway call with st in JSON, the way grpc-gateway does.
+func writeStatus(w http.ResponseWriter, httpStatus int, st *status.Status, header http.Header) {
+	out, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(st.Proto())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for key, values := range header {
+		w.Header()[key] = values
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	w.Write(out)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"broker/broker"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"toolbox/jsonutil"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// newLogService numbers the entries it is sent.
+func newLogService(t testing.TB, calls *atomic.Int32) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		jsonutil.Tools{}.WriteJSON(w, http.StatusAccepted, jsonutil.Response{Message: "logged " + strconv.Itoa(int(n))})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newBrokerClient(t *testing.T, app *Config) broker.BrokerClient {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := app.gRPCServer()
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return broker.NewBrokerClient(conn)
+}
+
+func logActions(url string) string {
+	return `{"actions": [{"name": "log", "transport": "http", "target": "` + url + `",
+		"schema": {"name": {"type": "string"}, "data": {"type": "string"}}}]}`
+}
+
+func TestGRPCLimitsIP(t *testing.T) {
+	var calls atomic.Int32
+	app := newTestApp(t, logActions(newLogService(t, &calls).URL))
+	app.RateLimiter.PerIP = Rate{Count: 2, Period: time.Minute}
+	client := newBrokerClient(t, app)
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.WriteLog(context.Background(), &broker.LogRequest{Name: "event", Data: "data"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var header metadata.MD
+	_, err := client.WriteLog(context.Background(), &broker.LogRequest{Name: "event", Data: "data"}, grpc.Header(&header))
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("got %v, want ResourceExhausted", err)
+	}
+	if len(header.Get("retry-after")) != 1 {
+		t.Errorf("no retry-after in %v", header)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("the log service got %d calls, want 2", n)
+	}
+}
+
+func TestGRPCIdempotencyKey(t *testing.T) {
+	var calls atomic.Int32
+	app := newTestApp(t, logActions(newLogService(t, &calls).URL))
+	client := newBrokerClient(t, app)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "idempotency-key", "log-1")
+
+	first, err := client.WriteLog(ctx, &broker.LogRequest{Name: "event", Data: "data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := client.WriteLog(ctx, &broker.LogRequest{Name: "event", Data: "data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.GetMessage() != first.GetMessage() {
+		t.Errorf("got %q again, want %q", again.GetMessage(), first.GetMessage())
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("the log service got %d calls, want 1", n)
+	}
+
+	_, err = client.WriteLog(ctx, &broker.LogRequest{Name: "event", Data: "other data"})
+	if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "different request") {
+		t.Fatalf("got %v for another request with the key", err)
+	}
+
+	// the gateway runs its calls once per key too
+	h := app.routes()
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/v1/log", strings.NewReader(`{"name": "event", "data": "data"}`))
+		r.Header.Set("Idempotency-Key", "log-2")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "logged 2") {
+			t.Fatalf("got status %d: %s", w.Code, w.Body)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("the log service got %d calls, want 2", n)
+	}
+}
+
+func TestGatewayLimitsActionsByIP(t *testing.T) {
+	var calls atomic.Int32
+	actions := strings.Replace(logActions(newLogService(t, &calls).URL), `"transport": "http",`, `"transport": "http", "rate_limit": "1/m",`, 1)
+	app := newTestApp(t, actions)
+	h := app.routes()
+	writeLog := func(addr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/log", strings.NewReader(`{"name": "event", "data": "data"}`))
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := writeLog("192.0.2.1:1234"); w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if w := writeLog("192.0.2.1:4321"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d again from the same address, want 429: %s", w.Code, w.Body)
+	}
+	if w := writeLog("192.0.2.2:1234"); w.Code != http.StatusOK {
+		t.Fatalf("got status %d from another address: %s", w.Code, w.Body)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("the log service got %d calls, want 2", n)
+	}
+}
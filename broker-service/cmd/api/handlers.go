@@ -1,282 +1,154 @@
 package main
 
 import (
-	"broker/event"
-	"broker/logs"
-	"bytes"
-	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
-	"net/rpc"
-	"time"
+	"net/url"
+	"slices"
+	"strings"
+	"toolbox/jsonutil"
 
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"github.com/go-chi/chi/v5"
 )
 
-type RequestPayload struct {
-	Action string      `json:"action"`
-	Auth   AuthPayload `json:"auth,omitempty"`
-	Log    LogPayload  `json:"log,omitempty"`
-	Mail   MailPayload `json:"mail,omitempty"`
-}
-type AuthPayload struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
-}
-type LogPayload struct {
-	Name string `json:"name"`
-	Data string `json:"data"`
-}
-type MailPayload struct {
-	From    string `json:"from"`
-	To      string `json:"to"`
-	Subject string `json:"subject"`
-	Message string `json:"message"`
-}
-
 // Broker is a method of the Config struct that serves as an HTTP handler.
 // It responds to incoming HTTP requests with a JSON response.
 func (app *Config) Broker(w http.ResponseWriter, r *http.Request) {
-	// Create a payload of type jsonResponce with a success message.
-	payload := jsonResponce{
+	// Create a payload with a success message.
+	payload := jsonutil.Response{
 		Error:   false,
 		Message: "Hit the broker",
 	}
 
-	_ = app.writeJSON(w, http.StatusOK, payload)
+	_ = app.JSON.WriteJSON(w, http.StatusOK, payload)
 
 }
 
-// HandleSubmission handles incoming HTTP requests and performs actions based on the request payload.
+// HandleSubmission runs the action named in the request. The payload is taken from
+// "payload", or from the field named after the action, e.g. {"action": "log", "log": {...}}.
+// Actions offering several transports are sent via "transport" when given. Requests
+// with an Idempotency-Key header are only run once per key.
 func (app *Config) HandleSubmission(w http.ResponseWriter, r *http.Request) {
-	// Declare a variable to hold the request payload.
-	var requestPayload RequestPayload
-
-	// Attempt to read the JSON data from the HTTP request into the requestPayload variable.
-	err := app.readJSON(w, r, &requestPayload)
-	if err != nil {
-		app.errorJSON(w, err)
-		return
-	}
-
-	// Determine the action to take based on the "Action" field in the request payload.
-	switch requestPayload.Action {
-	case "auth":
-		// If the action is "auth," call the authenticate function.
-		app.authenticate(w, requestPayload.Auth)
-	case "log":
-		app.logItemViaRPC(w, requestPayload.Log)
-	case "mail":
-		app.sendMail(w, requestPayload.Mail)
-	default:
-		// If the action is unknown, return an error JSON response.
-		app.errorJSON(w, errors.New("unknown action"))
-	}
+	app.handle(w, r, "")
 }
 
-func (app *Config) logItem(w http.ResponseWriter, entry LogPayload) {
-	jsonData, err := json.MarshalIndent(entry, "", "\t")
-	if err != nil {
-		app.errorJSON(w, err)
-		return
-	}
-	logServiceURL := "http://logger-service/log"
+// LogViaGRPC is kept for clients of /log-grpc; it runs the log action via gRPC.
+func (app *Config) LogViaGRPC(w http.ResponseWriter, r *http.Request) {
+	app.handle(w, r, TransportGRPC)
+}
 
-	request, err := http.NewRequest("POST", logServiceURL, bytes.NewBuffer(jsonData))
+func (app *Config) handle(w http.ResponseWriter, r *http.Request, transport string) {
+	var request map[string]json.RawMessage
+	err := app.JSON.ReadJSON(w, r, &request)
 	if err != nil {
-		app.errorJSON(w, err)
+		app.JSON.ErrorJSON(w, err)
 		return
 	}
-	request.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	responce, err := client.Do(request)
-	if err != nil {
-		app.errorJSON(w, err)
-		return
+	auth := app.authorizeOnce(r)
+	run := func() actionResult {
+		return app.dispatch(r, request, transport, auth)
 	}
-	defer responce.Body.Close()
-	if responce.StatusCode != http.StatusAccepted {
-		app.errorJSON(w, err)
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		app.writeResult(w, app.Idempotency.Do(r, key, request, run))
 		return
 	}
-	var payload jsonResponce
-	payload.Error = false
-	payload.Message = "logged"
-
-	app.writeJSON(w, http.StatusAccepted, payload)
+	app.writeResult(w, run())
 }
 
-func (app *Config) authenticate(w http.ResponseWriter, a AuthPayload) {
-
-	jsonData, _ := json.MarshalIndent(a, "", "\t")
-
-	request, err := http.NewRequest("POST", "http://authentication-service/authenticate", bytes.NewBuffer(jsonData))
-	if err != nil {
-		app.errorJSON(w, err)
-		return
+// dispatch runs the action described by one /handle request. The credentials are
+// checked with auth for actions that require authentication.
+func (app *Config) dispatch(r *http.Request, request map[string]json.RawMessage, transport string, auth *authorization) actionResult {
+	var name string
+	if err := json.Unmarshal(request["action"], &name); err != nil || name == "" {
+		return resultError(http.StatusBadRequest, errors.New("action is required"))
 	}
-
-	client := &http.Client{}
-	response, err := client.Do(request)
-	if err != nil {
-		app.errorJSON(w, err)
-		return
+	action, ok := app.Actions.Get(name)
+	if !ok {
+		return resultError(http.StatusBadRequest, errors.New("unknown action"))
 	}
-	defer response.Body.Close()
-
-	if response.StatusCode == http.StatusUnauthorized {
-		app.errorJSON(w, errors.New("invalid credentials"))
-		return
-	} else if response.StatusCode != http.StatusAccepted {
-		app.errorJSON(w, errors.New("error calling auth service"))
-		return
+	if raw, ok := request["transport"]; ok && transport == "" {
+		if err := json.Unmarshal(raw, &transport); err != nil {
+			return resultError(http.StatusBadRequest, errors.New("transport must be a string"))
+		}
 	}
-
-	var jsonResponse jsonResponce
-
-	err = json.NewDecoder(response.Body).Decode(&jsonResponse)
+	action, err := action.Via(transport)
 	if err != nil {
-		app.errorJSON(w, err)
-		return
+		return resultError(http.StatusBadRequest, err)
 	}
-
-	if jsonResponse.Error {
-		app.errorJSON(w, err, http.StatusUnauthorized)
-		return
+	payload, ok := request["payload"]
+	if !ok {
+		payload = request[name]
 	}
 
-	var payload jsonResponce
-	payload.Error = false
-	payload.Message = "Authenticated!"
-	payload.Data = jsonResponse.Data
-
-	app.writeJSON(w, http.StatusAccepted, payload)
-}
-
-func (app *Config) sendMail(w http.ResponseWriter, msg MailPayload) {
-	jsonData, _ := json.MarshalIndent(msg, "", "\t")
-
-	//call the mail service
-	mailServiceURL := "http://mail-service/send"
-
-	//post to mail service
-	request, err := http.NewRequest("POST", mailServiceURL, bytes.NewBuffer(jsonData))
-	if err != nil {
-		app.errorJSON(w, err)
-		return
+	// credentials are checked before the client is charged, so that a user is counted
+	// as such from any address. Refused ones are still charged to the IP, on top of
+	// being counted as failed authentications. Public actions leave them unchecked.
+	denied, authorized := actionResult{}, true
+	if action.AuthRequired {
+		denied, authorized = auth.check()
 	}
-
-	request.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	responce, err := client.Do(request)
-	if err != nil {
-		app.errorJSON(w, err)
-		return
+	if res, ok := app.RateLimiter.Allow(r, action, auth); !ok {
+		return res
 	}
-	defer responce.Body.Close()
-
-	//make sure that we get the right status code
-	if responce.StatusCode != http.StatusAccepted {
-		app.errorJSON(w, errors.New("error calling mail service"))
-		return
+	if action.AuthRequired && !authorized {
+		return denied
 	}
-
-	//send back json
-	var payload jsonResponce
-	payload.Error = false
-	payload.Message = "Message sent to " + msg.To
-
-	app.writeJSON(w, http.StatusAccepted, payload)
+	return app.runAction(r.Context(), action, payload)
 }
 
-func (app *Config) logEventViaRabbit(w http.ResponseWriter, l LogPayload) {
-	err := app.pushToQueue(l.Name, l.Data)
-	if err != nil {
-		app.errorJSON(w, err)
-		return
-	}
-	var payload jsonResponce
-	payload.Error = false
-	payload.Message = "logged via RabbitMQ"
-	app.writeJSON(w, http.StatusAccepted, payload)
-}
-func (app *Config) pushToQueue(name, msg string) error {
-	emitter, err := event.NewEventEmitter(app.Rabbit)
-	if err != nil {
-		return err
-	}
-	payload := LogPayload{
-		Name: name,
-		Data: msg,
-	}
-	j, _ := json.MarshalIndent(&payload, "", "\t")
-	err = emitter.Push(string(j), "log.INFO")
-	if err != nil {
-		return err
+// ListActions describes every action accepted by /handle.
+func (app *Config) ListActions(w http.ResponseWriter, r *http.Request) {
+	payload := jsonutil.Response{
+		Error:   false,
+		Message: "actions",
+		Data:    app.Actions.Actions,
 	}
-	return nil
+	app.JSON.WriteJSON(w, http.StatusOK, payload)
 }
 
-type RPCPayload struct {
-	Name string
-	Data string
+// MailStatus reports the delivery status (queued, sent or failed) of a message
+// previously accepted by the mail service.
+func (app *Config) MailStatus(w http.ResponseWriter, r *http.Request) {
+	status := &Action{
+		Name:       "mail status",
+		Transport:  TransportHTTP,
+		Target:     "http://mail-service/messages/" + url.PathEscape(chi.URLParam(r, "id")),
+		Method:     http.MethodGet,
+		Idempotent: true,
+		Timeout:    Duration(defaultActionTimeout),
+		downstream: app.Actions.Downstream("mail-service"),
+	}
+	if status.downstream != nil {
+		status.Timeout = status.downstream.Timeout
+	}
+	app.writeResult(w, app.callDownstream(r.Context(), status, nil))
 }
 
-func (app *Config) logItemViaRPC(w http.ResponseWriter, l LogPayload) {
-	client, err := rpc.Dial("tcp", "logger-service:5001")
-	if err != nil {
-		app.errorJSON(w, err)
-		return
-	}
-	rpcPayload := RPCPayload{
-		Name: l.Name,
-		Data: l.Data,
-	}
-	var result string
-	err = client.Call("RPCServer.LogInfo", rpcPayload, &result)
-	if err != nil {
-		app.errorJSON(w, err)
-		return
-	}
-	payload := jsonResponce{
-		Error:   false,
-		Message: result,
-	}
-	app.writeJSON(w, http.StatusAccepted, payload)
-
+// requireAdmin lets only the users listed in Admins through to next, authenticated
+// with Basic credentials like the actions requiring them.
+func (app *Config) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := app.authorizeOnce(r)
+		if res, ok := auth.check(); !ok {
+			app.writeResult(w, res)
+			return
+		}
+		email, _ := auth.user()
+		if !slices.ContainsFunc(app.Admins, func(admin string) bool { return strings.EqualFold(admin, email) }) {
+			app.writeResult(w, resultError(http.StatusForbidden, errors.New("admin access required")))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
-func (app *Config) LogViaGTPC(w http.ResponseWriter, r *http.Request) {
-	var requestPayload RequestPayload
-
-	err := app.readJSON(w, r, &requestPayload)
-	if err != nil {
-		app.errorJSON(w, err)
-		return
-	}
-	conn, err := grpc.Dial("logger-service:50001", grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
-	if err != nil {
-		app.errorJSON(w, err)
-		return
-	}
-	defer conn.Close()
-
-	c := logs.NewLogServiceClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	_, err = c.WriteLog(ctx, &logs.LogRequest{LogEntry: &logs.Log{Name: requestPayload.Log.Name, Data: requestPayload.Log.Data}})
-	if err != nil {
-		app.errorJSON(w, err)
-		return
+// Breakers reports the circuit breaker state of every downstream service.
+func (app *Config) Breakers(w http.ResponseWriter, r *http.Request) {
+	payload := jsonutil.Response{
+		Error:   false,
+		Message: "breakers",
+		Data:    app.Actions.Breakers(),
 	}
-
-	var payload jsonResponce
-	payload.Error = false
-	payload.Message = "logged"
-
-	app.writeJSON(w, http.StatusAccepted, payload)
+	app.JSON.WriteJSON(w, http.StatusOK, payload)
 }
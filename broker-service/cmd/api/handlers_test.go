@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestBreakersRequireAdmin(t *testing.T) {
+	var calls atomic.Int32
+	app := newTestApp(t, rateLimitActions(newAuthService(t, &calls).URL, newOKService(t).URL))
+	app.Admins = []string{"Admin@example.com"}
+	h := app.routes()
+
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		want     int
+	}{
+		{"anonymous", "", "", http.StatusUnauthorized},
+		{"wrong password", "admin@example.com", "guess", http.StatusUnauthorized},
+		{"user", "user@example.com", "secret", http.StatusForbidden},
+		{"admin", "admin@example.com", "secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/admin/breakers", nil)
+			if tt.email != "" {
+				r.SetBasicAuth(tt.email, tt.password)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
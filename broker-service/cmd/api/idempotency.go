@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultIdempotencyTTL is how long answers are replayed when BROKER_IDEMPOTENCY_TTL
+	// is not set.
+	defaultIdempotencyTTL = 24 * time.Hour
+	// idempotencyPendingTTL frees the key of a request that never finished, e.g.
+	// because the broker stopped while running it.
+	idempotencyPendingTTL = 2 * time.Minute
+)
+
+// IdempotencyRecord is what is kept for one Idempotency-Key: the request it was first
+// used for and, once that request is done, its answer.
+type IdempotencyRecord struct {
+	Key         string       `json:"key"`
+	Fingerprint string       `json:"fingerprint"`
+	Done        bool         `json:"done"`
+	Result      actionResult `json:"result"`
+	ExpiresAt   time.Time    `json:"expires_at"`
+}
+
+// IdempotencyStore keeps idempotency records.
+type IdempotencyStore interface {
+	// Begin stores rec unless its key is already taken by a record that has not
+	// expired, in which case that record is returned with ok set to false.
+	Begin(rec IdempotencyRecord) (existing IdempotencyRecord, ok bool, err error)
+	// Complete replaces the record of rec.Key.
+	Complete(rec IdempotencyRecord) error
+	// Release forgets the record of key.
+	Release(key string) error
+}
+
+// MemoryIdempotencyStore keeps records in memory; they are lost on restart.
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	records   map[string]IdempotencyRecord
+	lastPrune time.Time
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{records: make(map[string]IdempotencyRecord), lastPrune: time.Now()}
+}
+
+func (s *MemoryIdempotencyStore) Begin(rec IdempotencyRecord) (IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	if existing, ok := s.records[rec.Key]; ok && time.Now().Before(existing.ExpiresAt) {
+		return existing, false, nil
+	}
+	s.records[rec.Key] = rec
+	return rec, true, nil
+}
+
+func (s *MemoryIdempotencyStore) Complete(rec IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[rec.Key] = rec
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+// prune drops expired records, at most once a minute.
+func (s *MemoryIdempotencyStore) prune() []string {
+	if time.Since(s.lastPrune) < time.Minute {
+		return nil
+	}
+	s.lastPrune = time.Now()
+	var expired []string
+	for key, rec := range s.records {
+		if s.lastPrune.After(rec.ExpiresAt) {
+			delete(s.records, key)
+			expired = append(expired, key)
+		}
+	}
+	return expired
+}
+
+// FileIdempotencyStore keeps records in memory and as one JSON file per key, so
+// answers are still replayed after a restart.
+type FileIdempotencyStore struct {
+	dir string
+	mem *MemoryIdempotencyStore
+}
+
+// NewFileIdempotencyStore opens (or creates) dir and loads the records that have not
+// expired yet.
+func NewFileIdempotencyStore(dir string) (*FileIdempotencyStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &FileIdempotencyStore{dir: dir, mem: NewMemoryIdempotencyStore()}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var rec IdempotencyRecord
+		if err := json.Unmarshal(b, &rec); err != nil || now.After(rec.ExpiresAt) {
+			os.Remove(file)
+			continue
+		}
+		s.mem.records[rec.Key] = rec
+	}
+	return s, nil
+}
+
+func (s *FileIdempotencyStore) Begin(rec IdempotencyRecord) (IdempotencyRecord, bool, error) {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	for _, key := range s.mem.prune() {
+		os.Remove(s.file(key))
+	}
+	if existing, ok := s.mem.records[rec.Key]; ok && time.Now().Before(existing.ExpiresAt) {
+		return existing, false, nil
+	}
+	if err := s.write(rec); err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	s.mem.records[rec.Key] = rec
+	return rec, true, nil
+}
+
+func (s *FileIdempotencyStore) Complete(rec IdempotencyRecord) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	s.mem.records[rec.Key] = rec
+	return s.write(rec)
+}
+
+func (s *FileIdempotencyStore) Release(key string) error {
+	s.mem.mu.Lock()
+	defer s.mem.mu.Unlock()
+	delete(s.mem.records, key)
+	if err := os.Remove(s.file(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// write saves rec atomically, so a crash never leaves half a record behind.
+func (s *FileIdempotencyStore) write(rec IdempotencyRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	tmp := s.file(rec.Key) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file(rec.Key))
+}
+
+// file is the path of the record of key. Keys are hex digests, so they are safe
+// file names.
+func (s *FileIdempotencyStore) file(key string) string {
+	return filepath.Join(s.dir, key+".json")
+}
+
+// Idempotency replays the answer of a request for later requests sent with the same
+// Idempotency-Key, so clients can safely retry actions such as sending mail.
+type Idempotency struct {
+	Store IdempotencyStore
+	TTL   time.Duration
+}
+
+// Do runs run once per key. A request repeating the key gets the first answer again,
+// unless its payload differs or the first request is still running. Only answers that
+// a retry would get again are kept: successes and client errors. After a server error,
+// a timeout or throttling the key is released, so the request can be retried with it.
+func (idem *Idempotency) Do(r *http.Request, key string, request any, run func() actionResult) actionResult {
+	if len(key) > 255 || strings.IndexFunc(key, func(c rune) bool { return c < 0x21 || c > 0x7e }) >= 0 {
+		return resultError(http.StatusBadRequest, errors.New("Idempotency-Key must be at most 255 printable ASCII characters"))
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return resultError(http.StatusBadRequest, err)
+	}
+
+	// keys are only shared between requests with the same credentials
+	id := sha256.Sum256([]byte(r.Header.Get("Authorization") + "\x00" + key))
+	fingerprint := sha256.Sum256(append([]byte(r.URL.Path+"\x00"), body...))
+	rec := IdempotencyRecord{
+		Key:         hex.EncodeToString(id[:]),
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+		ExpiresAt:   time.Now().Add(idempotencyPendingTTL),
+	}
+
+	existing, ok, err := idem.Store.Begin(rec)
+	switch {
+	case err != nil:
+		return resultError(http.StatusInternalServerError, err)
+	case !ok && existing.Fingerprint != rec.Fingerprint:
+		return resultError(http.StatusUnprocessableEntity, errors.New("Idempotency-Key was already used for a different request"))
+	case !ok && !existing.Done:
+		res := resultError(http.StatusConflict, errors.New("a request with this Idempotency-Key is still in progress"))
+		res.Header = http.Header{}
+		res.Header.Set("Retry-After", "1")
+		return res
+	case !ok:
+		// the stored header is shared by every replay, so it is copied
+		res := existing.Result
+		res.Header = res.Header.Clone()
+		if res.Header == nil {
+			res.Header = http.Header{}
+		}
+		res.Header.Set("Idempotent-Replayed", "true")
+		return res
+	}
+
+	res := run()
+	if !replayable(res.Status) {
+		idem.Store.Release(rec.Key)
+		return res
+	}
+	rec.Done = true
+	rec.Result = res
+	rec.ExpiresAt = time.Now().Add(idem.TTL)
+	if err := idem.Store.Complete(rec); err != nil {
+		// the action did run, so its answer is still the one to send
+		log.Println("error storing idempotent answer:", err)
+	}
+	return res
+}
+
+// replayable reports whether an answer with status is final, i.e. running the same
+// request again would give the same answer.
+func replayable(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return false
+	}
+	return status >= 200 && status <= 299 || status >= 400 && status <= 499
+}
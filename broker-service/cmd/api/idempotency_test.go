@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIdempotencyKeepsOnlyFinalAnswers(t *testing.T) {
+	tests := []struct {
+		status int
+		replay bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusAccepted, true},
+		{http.StatusBadRequest, true},
+		{http.StatusNotFound, true},
+		{http.StatusUnprocessableEntity, true},
+		{http.StatusRequestTimeout, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusBadGateway, false},
+		{http.StatusServiceUnavailable, false},
+		{http.StatusGatewayTimeout, false},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			idem := &Idempotency{Store: NewMemoryIdempotencyStore(), TTL: defaultIdempotencyTTL}
+			runs := 0
+			run := func() actionResult {
+				runs++
+				if tt.status >= 400 {
+					return resultError(tt.status, errors.New(http.StatusText(tt.status)))
+				}
+				return resultOK(tt.status, "done", nil)
+			}
+
+			for i := 0; i < 2; i++ {
+				r := httptest.NewRequest(http.MethodPost, "/handle", nil)
+				if res := idem.Do(r, "key", map[string]string{"action": "mail"}, run); res.Status != tt.status {
+					t.Fatalf("got status %d", res.Status)
+				}
+			}
+			if want := map[bool]int{true: 1, false: 2}[tt.replay]; runs != want {
+				t.Errorf("the action ran %d times, want %d", runs, want)
+			}
+		})
+	}
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"broker/event"
+	"context"
 	"fmt"
 	"log"
 	"math"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
+	"toolbox/jsonutil"
+	"toolbox/tracing"
 
+	"github.com/graphql-go/graphql"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
@@ -15,9 +22,34 @@ const webPort = "80"
 
 type Config struct {
 	Rabbit *amqp.Connection
+	// JSON reads and writes the request and response bodies.
+	JSON jsonutil.Tools
+
+	// Actions are the actions accepted by /handle.
+	Actions *ActionRegistry
+	// Clients are the shared connections to the downstream services.
+	Clients *Clients
+	// RateLimiter throttles clients per IP and per action.
+	RateLimiter *RateLimiter
+	// Idempotency replays answers to requests repeating an Idempotency-Key.
+	Idempotency *Idempotency
+	// BatchParallelism is the number of requests of a batch run at once.
+	BatchParallelism int
+	// GraphQLSchema is served on /graphql, for queries at most GraphQLMaxDepth deep.
+	GraphQLSchema   *graphql.Schema
+	GraphQLMaxDepth int
+	// Admins are the emails of the users allowed on /admin.
+	Admins []string
 }
 
 func main() {
+	// trace requests across the services
+	shutdownTracing, err := tracing.Init("broker-service")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer shutdownTracing(context.Background())
+
 	//try to connect to rabbitmq
 	rabbitConn, err := connect()
 	if err != nil {
@@ -27,10 +59,102 @@ func main() {
 	defer rabbitConn.Close()
 	log.Println("Connected to RabbitMQ")
 
+	// load the actions accepted by /handle
+	actionsFile := os.Getenv("ACTIONS_FILE")
+	if actionsFile == "" {
+		actionsFile = "./actions.json"
+	}
+	actions, err := LoadActionRegistry(actionsFile)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// connections to the downstream services are made once and shared by all requests
+	rpcPoolSize := 4
+	if size := os.Getenv("BROKER_RPC_POOL_SIZE"); size != "" {
+		rpcPoolSize, err = strconv.Atoi(size)
+		if err != nil {
+			log.Panic("invalid BROKER_RPC_POOL_SIZE: ", err)
+		}
+	}
+	clients, err := NewClients(rabbitConn, rpcPoolSize)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer clients.Close()
+
+	batchParallelism := defaultBatchParallelism
+	if n := os.Getenv("BROKER_BATCH_PARALLELISM"); n != "" {
+		batchParallelism, err = strconv.Atoi(n)
+		if err != nil || batchParallelism < 1 {
+			log.Panic("invalid BROKER_BATCH_PARALLELISM: ", n)
+		}
+	}
+
+	// answers to requests with an Idempotency-Key are kept in memory, or on disk when
+	// BROKER_IDEMPOTENCY_DIR is set
+	idempotency := &Idempotency{Store: NewMemoryIdempotencyStore(), TTL: defaultIdempotencyTTL}
+	if ttl := os.Getenv("BROKER_IDEMPOTENCY_TTL"); ttl != "" {
+		idempotency.TTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			log.Panic("invalid BROKER_IDEMPOTENCY_TTL: ", err)
+		}
+	}
+	if dir := os.Getenv("BROKER_IDEMPOTENCY_DIR"); dir != "" {
+		idempotency.Store, err = NewFileIdempotencyStore(dir)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
+	ipRate := os.Getenv("BROKER_RATE_IP")
+	if ipRate == "" {
+		ipRate = defaultIPRate
+	}
+	perIP, err := parseRate(ipRate)
+	if err != nil {
+		log.Panic("invalid BROKER_RATE_IP: ", err)
+	}
+
 	// Create an instance of the Config struct.
 	app := Config{
-		Rabbit: rabbitConn,
+		Rabbit:           rabbitConn,
+		Actions:          actions,
+		Clients:          clients,
+		RateLimiter:      &RateLimiter{Store: NewMemoryRateLimitStore(), PerIP: perIP},
+		Idempotency:      idempotency,
+		BatchParallelism: batchParallelism,
+		GraphQLMaxDepth:  defaultGraphQLMaxDepth,
 	}
+	if n := os.Getenv("BROKER_GRAPHQL_MAX_DEPTH"); n != "" {
+		app.GraphQLMaxDepth, err = strconv.Atoi(n)
+		if err != nil || app.GraphQLMaxDepth < 1 {
+			log.Panic("invalid BROKER_GRAPHQL_MAX_DEPTH: ", n)
+		}
+	}
+	app.GraphQLSchema, err = app.graphQLSchema()
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, admin := range strings.Split(os.Getenv("BROKER_ADMINS"), ",") {
+		if admin = strings.TrimSpace(admin); admin != "" {
+			app.Admins = append(app.Admins, admin)
+		}
+	}
+
+	// queues of amqp actions must exist before their consumers first start, or the
+	// events published until then are dropped
+	for _, a := range actions.Targets() {
+		if a.Transport == TransportAMQP && a.Queue != "" {
+			err = event.DeclareDurableQueue(rabbitConn, a.Queue, []string{a.Target})
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+	}
+
+	// Serve the actions over gRPC as well.
+	go app.gRPCListen()
 
 	// Print a log message indicating that the broker service is starting on the specified port.
 	log.Printf("Starting broker service on port %s", webPort)
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultIPRate is used when BROKER_RATE_IP is not set.
+const defaultIPRate = "300/m"
+
+// Rate is a number of requests allowed per period. Periods are fixed windows, so a
+// daily rate is a quota that resets at midnight UTC.
+type Rate struct {
+	Count  int
+	Period time.Duration
+}
+
+// parseRate reads limits like "10/m", "500/h" or "1000/d". "off" disables the limit.
+func parseRate(s string) (Rate, error) {
+	if s == "off" {
+		return Rate{}, nil
+	}
+	count, unit, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q, use e.g. 10/m", s)
+	}
+	periods := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}
+	period, ok := periods[unit]
+	if !ok {
+		return Rate{}, fmt.Errorf("invalid rate %q, the unit must be s, m, h or d", s)
+	}
+	return Rate{Count: n, Period: period}, nil
+}
+
+func (r Rate) enabled() bool {
+	return r.Count > 0
+}
+
+func (r *Rate) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New(`rate must be a string such as "10/m"`)
+	}
+	v, err := parseRate(s)
+	if err != nil {
+		return err
+	}
+	*r = v
+	return nil
+}
+
+func (r Rate) MarshalJSON() ([]byte, error) {
+	if !r.enabled() {
+		return json.Marshal("off")
+	}
+	units := map[time.Duration]string{time.Second: "s", time.Minute: "m", time.Hour: "h", 24 * time.Hour: "d"}
+	return json.Marshal(fmt.Sprintf("%d/%s", r.Count, units[r.Period]))
+}
+
+// RateLimitStore counts requests per key and window. The in-memory store only limits
+// a single broker; running several needs a store they share.
+type RateLimitStore interface {
+	// Increment counts a request for key in the window starting at window and returns
+	// the count so far. The count may be forgotten after expires.
+	Increment(key string, window time.Time, expires time.Time) (int, error)
+	// Count returns the count of key in the window starting at window, without
+	// counting a request.
+	Count(key string, window time.Time) (int, error)
+}
+
+type windowKey struct {
+	key    string
+	window time.Time
+}
+
+type windowCount struct {
+	count   int
+	expires time.Time
+}
+
+// MemoryRateLimitStore keeps the counts in memory.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	counts    map[windowKey]*windowCount
+	lastPrune time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{counts: make(map[windowKey]*windowCount), lastPrune: time.Now()}
+}
+
+func (s *MemoryRateLimitStore) Increment(key string, window time.Time, expires time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastPrune) > time.Minute {
+		for k, c := range s.counts {
+			if now.After(c.expires) {
+				delete(s.counts, k)
+			}
+		}
+		s.lastPrune = now
+	}
+
+	k := windowKey{key: key, window: window}
+	c, ok := s.counts[k]
+	if !ok {
+		c = &windowCount{expires: expires}
+		s.counts[k] = c
+	}
+	c.count++
+	return c.count, nil
+}
+
+func (s *MemoryRateLimitStore) Count(key string, window time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.counts[windowKey{key: key, window: window}]; ok {
+		return c.count, nil
+	}
+	return 0, nil
+}
+
+// limitStatus is where one limit stands after a request, as sent in the RateLimit
+// headers.
+type limitStatus struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+	Exceeded  bool
+}
+
+// moreRestrictive reports whether s leaves less room than other.
+func (s limitStatus) moreRestrictive(other *limitStatus) bool {
+	switch {
+	case other == nil:
+		return true
+	case s.Exceeded != other.Exceeded:
+		return s.Exceeded
+	case s.Remaining != other.Remaining:
+		return s.Remaining < other.Remaining
+	}
+	return s.Reset.After(other.Reset)
+}
+
+// RateLimiter limits requests per client IP for the whole broker, and per client and
+// action with the rate limits and daily quotas of the actions. Clients are counted by
+// IP until their Basic credentials have been accepted, and as that user afterwards.
+type RateLimiter struct {
+	Store RateLimitStore
+	PerIP Rate
+}
+
+// window returns the start and the end of the current window of rate.
+func (r Rate) window() (time.Time, time.Time) {
+	window := time.Now().UTC().Truncate(r.Period)
+	return window, window.Add(r.Period)
+}
+
+// take counts a request against rate for key.
+func (rl *RateLimiter) take(key string, rate Rate) (limitStatus, error) {
+	window, reset := rate.window()
+	count, err := rl.Store.Increment(key, window, reset)
+	if err != nil {
+		return limitStatus{}, err
+	}
+	return limitStatus{
+		Limit:     rate.Count,
+		Remaining: max(rate.Count-count, 0),
+		Reset:     reset,
+		Exceeded:  count > rate.Count,
+	}, nil
+}
+
+type rateLimitContextKey struct{}
+
+// rateLimitHeaders collects the limits a request was counted against, to report the
+// most restrictive in the RateLimit headers.
+type rateLimitHeaders struct {
+	mu     sync.Mutex
+	status *limitStatus
+}
+
+func (h *rateLimitHeaders) add(s limitStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s.moreRestrictive(h.status) {
+		h.status = &s
+	}
+}
+
+func (h *rateLimitHeaders) write(header http.Header) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.status == nil {
+		return
+	}
+	reset := int(math.Ceil(time.Until(h.status.Reset).Seconds()))
+	header.Set("RateLimit-Limit", strconv.Itoa(h.status.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(h.status.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(reset))
+}
+
+// rateLimitWriter adds the RateLimit headers just before the response is written.
+type rateLimitWriter struct {
+	http.ResponseWriter
+	headers *rateLimitHeaders
+	written bool
+}
+
+func (w *rateLimitWriter) WriteHeader(status int) {
+	if !w.written {
+		w.written = true
+		w.headers.write(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *rateLimitWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// rateLimit limits the requests per client IP and sends the RateLimit headers of the
+// most restrictive limit the request was counted against.
+func (app *Config) rateLimit(next http.Handler) http.Handler {
+	rl := app.RateLimiter
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers := &rateLimitHeaders{}
+		r = r.WithContext(context.WithValue(r.Context(), rateLimitContextKey{}, headers))
+		w = &rateLimitWriter{ResponseWriter: w, headers: headers}
+
+		if rl.PerIP.enabled() {
+			status, err := rl.take("ip:"+clientIP(r), rl.PerIP)
+			if err != nil {
+				// a broken store must not take the broker down with it
+				next.ServeHTTP(w, r)
+				return
+			}
+			headers.add(status)
+			if status.Exceeded {
+				app.writeResult(w, tooManyRequests(status, "too many requests"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Allow counts a request for action against its rate limit and daily quota. Clients
+// whose credentials auth has accepted are counted as their user, from whatever IP,
+// and the others by IP. It never checks credentials itself: dispatch checks them
+// first for the actions requiring them.
+func (rl *RateLimiter) Allow(r *http.Request, action *Action, auth *authorization) (actionResult, bool) {
+	if !action.RateLimit.enabled() && !action.Quota.enabled() {
+		return actionResult{}, true
+	}
+
+	subject := "ip:" + clientIP(r)
+	if email, ok := auth.user(); ok {
+		subject = "user:" + email
+	}
+	headers, _ := r.Context().Value(rateLimitContextKey{}).(*rateLimitHeaders)
+
+	for _, limit := range []struct {
+		name    string
+		rate    Rate
+		message string
+	}{
+		{"rate", action.RateLimit, "too many " + action.Name + " requests"},
+		{"quota", action.Quota, "daily quota for " + action.Name + " used up"},
+	} {
+		if !limit.rate.enabled() {
+			continue
+		}
+		status, err := rl.take(limitKey(limit.name, action.Name, subject), limit.rate)
+		if err != nil {
+			continue
+		}
+		if headers != nil {
+			headers.add(status)
+		}
+		if status.Exceeded {
+			return tooManyRequests(status, limit.message), false
+		}
+	}
+	return actionResult{}, true
+}
+
+// AllowAuthentication reports whether the client may still send credentials. Failed
+// attempts are counted with the requests of the authenticator action from the same IP,
+// so they share its rate limit.
+func (rl *RateLimiter) AllowAuthentication(r *http.Request, authenticator *Action) (actionResult, bool) {
+	if authenticator == nil || !authenticator.RateLimit.enabled() {
+		return actionResult{}, true
+	}
+	rate := authenticator.RateLimit
+	window, reset := rate.window()
+	count, err := rl.Store.Count(authenticationKey(r, authenticator), window)
+	if err != nil || count < rate.Count {
+		return actionResult{}, true
+	}
+	return tooManyRequests(limitStatus{Limit: rate.Count, Reset: reset, Exceeded: true}, "too many failed authentications"), false
+}
+
+// AuthenticationFailed counts credentials of the client that were refused.
+func (rl *RateLimiter) AuthenticationFailed(r *http.Request, authenticator *Action) {
+	if authenticator == nil || !authenticator.RateLimit.enabled() {
+		return
+	}
+	rl.take(authenticationKey(r, authenticator), authenticator.RateLimit)
+}
+
+// limitKey is the key requests of subject for action are counted under.
+func limitKey(limit, action, subject string) string {
+	return limit + ":" + action + ":" + subject
+}
+
+// authenticationKey is the key the requests of the authenticator action from the IP
+// of r are counted under.
+func authenticationKey(r *http.Request, authenticator *Action) string {
+	return limitKey("rate", authenticator.Name, "ip:"+clientIP(r))
+}
+
+func tooManyRequests(status limitStatus, message string) actionResult {
+	res := resultError(http.StatusTooManyRequests, errors.New(message))
+	res.Header = http.Header{}
+	res.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(status.Reset).Seconds()))))
+	return res
+}
+
+// clientIP is the address the request came from. Forwarding headers are ignored, as
+// the broker is reached directly and clients could set them to anything.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
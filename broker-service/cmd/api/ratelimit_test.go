@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"toolbox/jsonutil"
+)
+
+// newTestApp returns a broker running the actions described by actions, a JSON
+// action registry.
+func newTestApp(t testing.TB, actions string) *Config {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "actions.json")
+	if err := os.WriteFile(file, []byte(actions), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	reg, err := LoadActionRegistry(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients, err := NewClients(nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(clients.Close)
+
+	app := &Config{
+		Actions:          reg,
+		Clients:          clients,
+		RateLimiter:      &RateLimiter{Store: NewMemoryRateLimitStore()},
+		Idempotency:      &Idempotency{Store: NewMemoryIdempotencyStore(), TTL: defaultIdempotencyTTL},
+		BatchParallelism: defaultBatchParallelism,
+		GraphQLMaxDepth:  defaultGraphQLMaxDepth,
+	}
+	app.GraphQLSchema, err = app.graphQLSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+// newAuthService stands in for the authentication service: "secret" is the password
+// of every user. calls counts the credentials it was asked to check.
+func newAuthService(t testing.TB, calls *atomic.Int32) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var credentials struct {
+			Email    string `json:"email"`
+			Password string `json:"password"`
+		}
+		json.NewDecoder(r.Body).Decode(&credentials)
+		tools := jsonutil.Tools{}
+		if credentials.Password != "secret" {
+			tools.ErrorJSON(w, jsonutil.NewError(http.StatusUnauthorized, "", "invalid credentials"))
+			return
+		}
+		tools.WriteJSON(w, http.StatusAccepted, jsonutil.Response{Message: "ok", Data: map[string]string{"email": credentials.Email}})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newOKService(t testing.TB) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jsonutil.Tools{}.WriteJSON(w, http.StatusAccepted, jsonutil.Response{Message: "done"})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func rateLimitActions(authURL, serviceURL string) string {
+	return `{
+		"authenticator": "auth",
+		"actions": [
+			{"name": "auth", "transport": "http", "target": "` + authURL + `", "rate_limit": "3/m",
+				"schema": {"email": {"type": "string"}, "password": {"type": "string"}}},
+			{"name": "secret", "transport": "http", "target": "` + serviceURL + `", "auth_required": true, "rate_limit": "100/m"},
+			{"name": "public", "transport": "http", "target": "` + serviceURL + `", "rate_limit": "100/m"}
+		]
+	}`
+}
+
+func handleAction(t testing.TB, h http.Handler, action, password string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/handle", strings.NewReader(`{"action": "`+action+`"}`))
+	r.Header.Set("Content-Type", "application/json")
+	if password != "" {
+		r.SetBasicAuth("user@example.com", password)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestFailedAuthenticationIsThrottled(t *testing.T) {
+	var calls atomic.Int32
+	app := newTestApp(t, rateLimitActions(newAuthService(t, &calls).URL, newOKService(t).URL))
+	h := app.routes()
+
+	for i := 0; i < 3; i++ {
+		if w := handleAction(t, h, "secret", "guess"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: got status %d, want 401", i+1, w.Code)
+		}
+	}
+	// the authenticator allows 3 requests a minute, failed credentials included
+	w := handleAction(t, h, "secret", "secret")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d after 3 failures, want 429", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Retry-After is not set")
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("the authentication service was called %d times, want 3", n)
+	}
+	if w := handleAction(t, h, "auth", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("the authenticator itself answered %d, want 429", w.Code)
+	}
+}
+
+func TestCredentialsAreCheckedOnlyWhenRequired(t *testing.T) {
+	var calls atomic.Int32
+	app := newTestApp(t, rateLimitActions(newAuthService(t, &calls).URL, newOKService(t).URL))
+	h := app.routes()
+
+	if w := handleAction(t, h, "public", "secret"); w.Code != http.StatusAccepted {
+		t.Fatalf("public action: got status %d, want 202", w.Code)
+	}
+	if n := calls.Load(); n != 0 {
+		t.Errorf("a public action checked the credentials %d times", n)
+	}
+
+	if w := handleAction(t, h, "secret", "secret"); w.Code != http.StatusAccepted {
+		t.Fatalf("secret action: got status %d, want 202", w.Code)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("the credentials were checked %d times, want once", n)
+	}
+}
+
+func TestUsersAreLimitedFromAnyAddress(t *testing.T) {
+	var calls atomic.Int32
+	actions := strings.Replace(rateLimitActions(newAuthService(t, &calls).URL, newOKService(t).URL),
+		`"auth_required": true, "rate_limit": "100/m"`, `"auth_required": true, "rate_limit": "1/m"`, 1)
+	app := newTestApp(t, actions)
+	h := app.routes()
+	handleFrom := func(addr, email string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/handle", strings.NewReader(`{"action": "secret"}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.RemoteAddr = addr
+		r.SetBasicAuth(email, "secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := handleFrom("192.0.2.1:1234", "user@example.com"); w.Code != http.StatusAccepted {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if w := handleFrom("192.0.2.2:1234", "user@example.com"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d for the same user from another address, want 429: %s", w.Code, w.Body)
+	}
+	if w := handleFrom("192.0.2.1:1234", "other@example.com"); w.Code != http.StatusAccepted {
+		t.Fatalf("got status %d for another user from the same address: %s", w.Code, w.Body)
+	}
+}
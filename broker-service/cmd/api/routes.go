@@ -2,35 +2,64 @@ package main
 
 import (
 	"net/http"
+	"toolbox/tracing"
+	"toolbox/web"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/cors"
 )
 
 func (app *Config) routes() http.Handler {
 
 	mux := chi.NewRouter()
 
-	// Enable Cross-Origin Resource Sharing (CORS) middleware to specify who is allowed to connect.
-	mux.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"https://*", "http://*"},                                  // Allow requests from any origin with HTTP or HTTPS.
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},                // Allow specified HTTP methods.
-		AllowedHeaders:   []string{"Accept", "Authorizaton", "Content-Type", "X-CSRG-Token"}, // Allow specific headers.
-		ExposedHeaders:   []string{"Link"},                                                   // Expose the 'Link' header in responses.
-		AllowCredentials: true,                                                               // Allow sending credentials (e.g., cookies) with requests.
-		MaxAge:           300,                                                                // Cache preflight (OPTIONS) request results for 300 seconds.
+	// Trace every request, continuing the trace of the caller.
+	mux.Use(tracing.Handler)
+
+	// Enable Cross-Origin Resource Sharing middleware to specify who is allowed to connect,
+	// from the origins listed in CORS_ALLOWED_ORIGINS.
+	mux.Use(web.CORS(web.CORSOptions{
+		AllowedHeaders: []string{"Idempotency-Key"},
+		ExposedHeaders: []string{"Idempotent-Replayed", "Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"},
 	}))
 
+	// Send the standard security headers (HSTS, CSP, nosniff) with every response.
+	mux.Use(web.SecurityHeaders(web.SecurityOptions{}))
+
 	// Add a middleware that responds to a '/ping' endpoint with a heartbeat message.
 	mux.Use(middleware.Heartbeat("/ping"))
 
+	// Throttle clients, and tell them where they stand in the RateLimit headers.
+	mux.Use(app.rateLimit)
+
 	// Register a POST handler for the root path '/' that calls the app's Broker method to handle the request.
 	mux.Post("/", app.Broker)
 
-	mux.Post("/log-grpc", app.LogViaGTPC)
+	mux.Post("/log-grpc", app.LogViaGRPC)
 
 	mux.Post("/handle", app.HandleSubmission)
+
+	// Run several /handle requests at once.
+	mux.Post("/handle/batch", app.HandleBatch)
+
+	// Typed access to the actions of /handle.
+	mux.Post("/graphql", app.GraphQL)
+
+	// JSON mapping of the Broker gRPC service, sharing its implementation.
+	srv := &BrokerServer{app: app}
+	mux.Post("/v1/authenticate", gatewayHandler(app, srv.Authenticate))
+	mux.Post("/v1/mail", gatewayHandler(app, srv.SendMail))
+	mux.Post("/v1/log", gatewayHandler(app, srv.WriteLog))
+
+	// Describe the actions accepted by /handle.
+	mux.Get("/actions", app.ListActions)
+
+	// Report the delivery status of a message accepted by the mail service.
+	mux.Get("/mail/{id}", app.MailStatus)
+
+	// Show the circuit breaker state of the downstream services, to admins only.
+	mux.With(app.requireAdmin).Get("/admin/breakers", app.Breakers)
+
 	// Return the configured router as an HTTP handler.
 	return mux
 }
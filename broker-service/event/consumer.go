@@ -2,10 +2,12 @@ package event
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"toolbox/tracing"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
@@ -76,7 +78,11 @@ func (consumer *Consumer) Listen(topics []string) error {
 			var payload Payload
 			_ = json.Unmarshal(d.Body, &payload)
 
-			go handlePayload(payload)
+			ctx, span := tracing.StartConsume("logs_topic", d.RoutingKey, d.Headers)
+			go func() {
+				defer span.End()
+				handlePayload(ctx, payload)
+			}()
 		}
 	}()
 	fmt.Printf("Waiting for message [Exchange, Queue][logs_topic,%s]\n", q.Name)
@@ -84,25 +90,28 @@ func (consumer *Consumer) Listen(topics []string) error {
 	return nil
 }
 
-func handlePayload(payload Payload) {
+func handlePayload(ctx context.Context, payload Payload) {
 	switch payload.Name {
 	case "log", "event":
 		//log whatever we get
-		err := logEvent(payload)
+		err := logEvent(ctx, payload)
 		if err != nil {
 			log.Println(err)
 		}
 	case "auth":
 
 	default:
-		err := logEvent(payload)
+		err := logEvent(ctx, payload)
 		if err != nil {
 			log.Println(err)
 		}
 	}
 }
 
-func logEvent(entry Payload) error {
+// client sends the events to the logger, passing the trace on.
+var client = &http.Client{Transport: tracing.Transport(nil)}
+
+func logEvent(ctx context.Context, entry Payload) error {
 	jsonData, err := json.MarshalIndent(entry, "", "\t")
 	if err != nil {
 
@@ -110,13 +119,12 @@ func logEvent(entry Payload) error {
 	}
 	logServiceURL := "http://logger-service/log"
 
-	request, err := http.NewRequest("POST", logServiceURL, bytes.NewBuffer(jsonData))
+	request, err := http.NewRequestWithContext(ctx, "POST", logServiceURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return err
 	}
 	request.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
 	responce, err := client.Do(request)
 	if err != nil {
 		return err
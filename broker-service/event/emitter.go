@@ -1,13 +1,20 @@
 package event
 
 import (
-	"log"
+	"context"
+	"toolbox/tracing"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+// emitterChannels is the number of idle channels an Emitter keeps open.
+const emitterChannels = 16
+
+// Emitter publishes events. It is safe for concurrent use: every publish takes a
+// channel from a pool, since an AMQP channel must not be shared between goroutines.
 type Emitter struct {
 	connection *amqp.Connection
+	channels   chan *amqp.Channel
 }
 
 func (e *Emitter) setup() error {
@@ -18,31 +25,80 @@ func (e *Emitter) setup() error {
 	defer channel.Close()
 	return declaerExchange(channel)
 }
-func (e *Emitter) Push(event string, severity string) error {
-	channel, err := e.connection.Channel()
+
+// PushJSON publishes a persistent JSON event under the given routing key, tagged with
+// id so consumers can recognise redeliveries. The trace of ctx goes along in the
+// message headers.
+func (e *Emitter) PushJSON(ctx context.Context, body []byte, key string, id string) (err error) {
+	ctx, span, headers := tracing.StartPublish(ctx, "logs_topic", key)
+	defer func() { tracing.End(span, err) }()
+
+	channel, err := e.channel()
 	if err != nil {
 		return err
 	}
-	defer channel.Close()
-	log.Println("Pushin to channel")
-	err = channel.Publish(
-		"log_topic",
-		severity,
+	err = channel.PublishWithContext(
+		ctx,
+		"logs_topic",
+		key,
 		false,
 		false,
 		amqp.Publishing{
-			ContentType: "text/plain",
-			Body:        []byte(event),
+			Headers:      headers,
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    id,
+			Body:         body,
 		},
 	)
 	if err != nil {
+		// a failed publish closes the channel, so it is not returned to the pool
+		channel.Close()
 		return err
 	}
+	e.release(channel)
 	return nil
 }
+
+// channel takes an idle channel from the pool, or opens a new one.
+func (e *Emitter) channel() (*amqp.Channel, error) {
+	for {
+		select {
+		case channel := <-e.channels:
+			if channel.IsClosed() {
+				continue
+			}
+			return channel, nil
+		default:
+			return e.connection.Channel()
+		}
+	}
+}
+
+func (e *Emitter) release(channel *amqp.Channel) {
+	select {
+	case e.channels <- channel:
+	default:
+		channel.Close()
+	}
+}
+
+// Close closes the idle channels. The connection belongs to the caller.
+func (e *Emitter) Close() {
+	for {
+		select {
+		case channel := <-e.channels:
+			channel.Close()
+		default:
+			return
+		}
+	}
+}
+
 func NewEventEmitter(conn *amqp.Connection) (Emitter, error) {
 	emitter := Emitter{
 		connection: conn,
+		channels:   make(chan *amqp.Channel, emitterChannels),
 	}
 	err := emitter.setup()
 	if err != nil {
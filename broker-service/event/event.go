@@ -27,3 +27,34 @@ func declareRandomQueue(ch *amqp.Channel) (amqp.Queue, error) {
 		nil,   //arguments?
 	)
 }
+
+// DeclareDurableQueue makes sure the named queue exists and is bound to keys, so
+// events published before its consumer first starts are kept.
+func DeclareDurableQueue(conn *amqp.Connection, name string, keys []string) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if err := declaerExchange(ch); err != nil {
+		return err
+	}
+	q, err := ch.QueueDeclare(
+		name,  //name?
+		true,  //durable?
+		false, //delete when unused?
+		false, //explusive?
+		false, //no-wait?
+		nil,   //arguments?
+	)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := ch.QueueBind(q.Name, key, "logs_topic", false, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
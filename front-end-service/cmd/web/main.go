@@ -1,21 +1,40 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"toolbox/tracing"
+	"toolbox/web"
 )
 
+// contentSecurityPolicy lets the test page run its inline script, load Bootstrap and
+// call the broker.
+const contentSecurityPolicy = "default-src 'self'; script-src 'self' 'unsafe-inline'; " +
+	"style-src 'self' 'unsafe-inline' https://cdn.jsdelivr.net; connect-src 'self' http://localhost:8080; " +
+	"frame-ancestors 'none'"
+
 const webPort = "8082"
 
 func main() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	shutdownTracing, err := tracing.Init("front-end-service")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer shutdownTracing(context.Background())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		render(w, "test.page.gohtml")
 	})
 
 	fmt.Println("Starting front end service on port 8082")
-	err := http.ListenAndServe(fmt.Sprintf(":%s", webPort), nil)
+	handler := web.CORS(web.CORSOptions{})(web.SecurityHeaders(web.SecurityOptions{
+		ContentSecurityPolicy: contentSecurityPolicy,
+	})(mux))
+	err = http.ListenAndServe(fmt.Sprintf(":%s", webPort), tracing.Handler(handler))
 	if err != nil {
 		log.Panic(err)
 	}
@@ -1,17 +1,26 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"listener/event"
 	"log"
 	"math"
 	"os"
 	"time"
+	"toolbox/tracing"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 func main() {
+	//trace the events across the services
+	shutdownTracing, err := tracing.Init("listener-service")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer shutdownTracing(context.Background())
+
 	//try to connect to rabbitmq
 	rabbitConn, err := connect()
 	if err != nil {
@@ -28,7 +37,7 @@ func main() {
 		panic(err)
 	}
 	//watch the queuq and consume events
-	err = consumer.Listen([]string{"log.INFO", "log.WARNING", "log.ERROR"})
+	err = consumer.Listen([]string{"log.INFO", "log.WARNING", "log.ERROR", "mail.sent", "mail.failed"})
 	if err != nil {
 		log.Println(err)
 	}
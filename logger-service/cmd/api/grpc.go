@@ -7,8 +7,12 @@ import (
 	"log-service/data"
 	"log-service/logs"
 	"net"
+	"toolbox/jsonutil"
+	"toolbox/tracing"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type LogServer struct {
@@ -18,6 +22,9 @@ type LogServer struct {
 
 func (l *LogServer) WriteLog(ctx context.Context, req *logs.LogRequest) (*logs.LogResponse, error) {
 	input := req.GetLogEntry()
+	if err := jsonutil.Validate(JSONPayload{Name: input.GetName(), Data: input.GetData()}); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	//write the log
 	logEntry := data.LogEntry{
@@ -39,7 +46,7 @@ func (app *Config) gRPCListen() {
 	if err != nil {
 		log.Fatalf("Failed to listen for gRPC: %v", err)
 	}
-	s := grpc.NewServer()
+	s := grpc.NewServer(grpc.UnaryInterceptor(tracing.UnaryServerInterceptor()))
 
 	logs.RegisterLogServiceServer(s, &LogServer{Model: app.Models})
 
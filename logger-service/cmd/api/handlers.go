@@ -1,20 +1,38 @@
 package main
 
 import (
+	"errors"
 	"log-service/data"
 	"net/http"
+	"strconv"
+	"toolbox/jsonutil"
+)
+
+const (
+	// defaultLogsLimit is the number of entries ReadLogs returns when no limit is given.
+	defaultLogsLimit = 20
+	// maxLogsLimit is the most entries ReadLogs returns at once.
+	maxLogsLimit = 100
 )
 
 type JSONPayload struct {
-	Name string `json:"name"`
-	Data string `json:"data"`
+	Name string `json:"name" validate:"required,max=255"`
+	Data string `json:"data" validate:"required,max=65536"`
+}
+
+func init() {
+	jsonutil.MustCheckTags(JSONPayload{}, RPCPayload{})
 }
 
 func (app *Config) WriteLog(w http.ResponseWriter, r *http.Request) {
 	//read json into var
 
 	var requestPayload JSONPayload
-	_ = app.readJSON(w, r, &requestPayload)
+	err := app.JSON.ReadJSON(w, r, &requestPayload)
+	if err != nil {
+		app.JSON.ErrorJSON(w, err)
+		return
+	}
 
 	//insert data
 	event := data.LogEntry{
@@ -22,15 +40,42 @@ func (app *Config) WriteLog(w http.ResponseWriter, r *http.Request) {
 		Data: requestPayload.Data,
 	}
 
-	err := app.Models.LogEntry.Insert(event)
+	err = app.Models.LogEntry.Insert(event)
 	if err != nil {
-		app.errorJSON(w, err)
+		app.JSON.ErrorJSON(w, err, http.StatusInternalServerError)
 		return
 	}
 
-	resp := jsonResponce{
+	resp := jsonutil.Response{
 		Error:   false,
 		Message: "logged",
 	}
-	app.writeJSON(w, http.StatusAccepted, resp)
+	app.JSON.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// ReadLogs returns the latest log entries, newest first. The optional query parameters
+// are name, to only return entries with that name, and limit.
+func (app *Config) ReadLogs(w http.ResponseWriter, r *http.Request) {
+	limit := defaultLogsLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxLogsLimit {
+			app.JSON.ErrorJSON(w, errors.New("limit must be a number from 1 to "+strconv.Itoa(maxLogsLimit)))
+			return
+		}
+		limit = n
+	}
+
+	logs, err := app.Models.LogEntry.Latest(r.URL.Query().Get("name"), int64(limit))
+	if err != nil {
+		app.JSON.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := jsonutil.Response{
+		Error:   false,
+		Message: "logs",
+		Data:    logs,
+	}
+	app.JSON.WriteJSON(w, http.StatusOK, resp)
 }
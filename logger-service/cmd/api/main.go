@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"net/rpc"
 	"time"
+	"toolbox/jsonutil"
+	"toolbox/tracing"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -25,10 +27,18 @@ var client *mongo.Client
 
 type Config struct {
 	Models data.Models
+	JSON   jsonutil.Tools
 }
 
 func main() {
 
+	// trace requests across the services
+	shutdownTracing, err := tracing.Init("logger-service")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer shutdownTracing(context.Background())
+
 	// connect to mongodb
 	mongoClient, err := connectToMongo()
 	if err != nil {
@@ -1,22 +1,32 @@
 package main
 
 import (
-	"context"
 	"log"
 	"log-service/data"
 	"time"
+	"toolbox/jsonutil"
+	"toolbox/tracing"
 )
 
 type RPCServer struct{}
 
 type RPCPayload struct {
-	Name string
-	Data string
+	Name string `validate:"required,max=255"`
+	Data string `validate:"required,max=65536"`
+	// TraceContext is the trace of the caller.
+	TraceContext map[string]string
 }
 
-func (r *RPCServer) LogInfo(payload RPCPayload, resp *string) error {
+func (r *RPCServer) LogInfo(payload RPCPayload, resp *string) (err error) {
+	ctx, span := tracing.StartRPCServer(payload.TraceContext, "RPCServer.LogInfo")
+	defer func() { tracing.End(span, err) }()
+
+	if err := jsonutil.Validate(payload); err != nil {
+		return err
+	}
+
 	collection := client.Database("logs").Collection("logs")
-	_, err := collection.InsertOne(context.TODO(), data.LogEntry{
+	_, err = collection.InsertOne(ctx, data.LogEntry{
 		Name:      payload.Name,
 		Data:      payload.Data,
 		CreatedAt: time.Now(),
@@ -29,7 +29,7 @@ type Models struct {
 // LogEntry is a struct representing a log entry document in MongoDB.
 type LogEntry struct {
 	ID        string    `bson:"_id,omitempty" json:"id,omitempty"`
-	Name      string    `bson:"name" json"name"`
+	Name      string    `bson:"name" json:"name"`
 	Data      string    `bson:"data" json:"data"`
 	CreatedAt time.Time `bson:"created_at" json:"created_at"`
 	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
@@ -95,6 +95,42 @@ func (l *LogEntry) All() ([]*LogEntry, error) {
 	return logs, nil
 }
 
+// Latest retrieves the most recent log entries, newest first, at most limit of them.
+// When name is not empty, only entries with that name are returned.
+func (l *LogEntry) Latest(name string, limit int64) ([]*LogEntry, error) {
+	// Create a context with a timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	// Get the 'logs' collection from the MongoDB database.
+	collection := client.Database("logs").Collection("logs")
+
+	// Only match entries with the given name, if any.
+	filter := bson.M{}
+	if name != "" {
+		filter["name"] = name
+	}
+
+	// Sort by 'created_at' in descending order and stop after limit entries.
+	opts := options.Find()
+	opts.SetSort(bson.D{{Key: "created_at", Value: -1}})
+	opts.SetLimit(limit)
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		log.Println("Finding latest docs error:", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	logs := []*LogEntry{}
+	if err := cursor.All(ctx, &logs); err != nil {
+		log.Println("Error decoding logs into slice", err)
+		return nil, err
+	}
+	return logs, nil
+}
+
 // GetOne retrieves a single log entry from the MongoDB collection 'logs' by its ID.
 // It returns the retrieved log entry as a pointer to LogEntry and an error if the operation fails.
 func (l *LogEntry) GetOne(id string) (*LogEntry, error) {
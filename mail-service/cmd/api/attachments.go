@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Attachment is a file sent along with a message. In JSON the data is base64 encoded.
+// Inline attachments are not listed as downloads but can be referenced from the HTML
+// body with src="cid:<name>", see the cid template function.
+type Attachment struct {
+	Name        string `json:"name" validate:"max=255"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+	Inline      bool   `json:"inline,omitempty"`
+}
+
+// AttachmentLimits restricts what callers may attach to a single message.
+type AttachmentLimits struct {
+	MaxFileSize  int64
+	MaxTotalSize int64
+	MaxFiles     int
+	AllowedTypes []string
+}
+
+var defaultAttachmentTypes = []string{
+	"application/pdf",
+	"application/zip",
+	"image/gif",
+	"image/jpeg",
+	"image/png",
+	"text/csv",
+	"text/plain",
+}
+
+func createAttachmentLimits() AttachmentLimits {
+	limits := AttachmentLimits{
+		MaxFileSize:  int64(envInt("MAIL_ATTACHMENT_MAX_BYTES", 5<<20)),
+		MaxTotalSize: int64(envInt("MAIL_ATTACHMENTS_MAX_TOTAL_BYTES", 10<<20)),
+		MaxFiles:     envInt("MAIL_ATTACHMENTS_MAX_FILES", 10),
+		AllowedTypes: defaultAttachmentTypes,
+	}
+	if types := os.Getenv("MAIL_ATTACHMENT_TYPES"); types != "" {
+		limits.AllowedTypes = strings.Split(types, ",")
+	}
+	return limits
+}
+
+// MaxRequestSize is the largest request body that can carry attachments within the
+// limits, allowing for base64 overhead plus the rest of the message.
+func (l AttachmentLimits) MaxRequestSize() int64 {
+	return l.MaxTotalSize/3*4 + 1<<20
+}
+
+// Check normalizes the attachments in place (file names and content types) and
+// returns an error if any limit is exceeded.
+func (l AttachmentLimits) Check(attachments []Attachment) error {
+	if len(attachments) > l.MaxFiles {
+		return fmt.Errorf("too many attachments: %d, at most %d allowed", len(attachments), l.MaxFiles)
+	}
+
+	var total int64
+	for i := range attachments {
+		a := &attachments[i]
+
+		// only keep the base name, a path has no meaning to the recipient
+		a.Name = filepath.Base(strings.ReplaceAll(a.Name, "\\", "/"))
+		if a.Name == "" || a.Name == "." || a.Name == "/" {
+			return errors.New("attachment name is required")
+		}
+		if len(a.Data) == 0 {
+			return fmt.Errorf("attachment %s is empty", a.Name)
+		}
+
+		size := int64(len(a.Data))
+		if size > l.MaxFileSize {
+			return fmt.Errorf("attachment %s is %d bytes, at most %d allowed", a.Name, size, l.MaxFileSize)
+		}
+		total += size
+		if total > l.MaxTotalSize {
+			return fmt.Errorf("attachments exceed %d bytes in total", l.MaxTotalSize)
+		}
+
+		// the declared type is only a claim of the client, what counts is the content
+		sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(a.Data))
+		if a.ContentType == "" {
+			a.ContentType = sniffed
+		}
+		mediaType, _, err := mime.ParseMediaType(a.ContentType)
+		if err != nil {
+			return fmt.Errorf("attachment %s has invalid content type: %w", a.Name, err)
+		}
+		if !contentMatches(mediaType, sniffed) {
+			return fmt.Errorf("attachment %s is declared as %s but its content is %s", a.Name, mediaType, sniffed)
+		}
+		for _, t := range []string{mediaType, sniffed} {
+			if !l.allowed(t) {
+				return fmt.Errorf("attachment %s has content type %s, which is not allowed", a.Name, t)
+			}
+		}
+		if a.Inline && !strings.HasPrefix(mediaType, "image/") {
+			return fmt.Errorf("attachment %s: only images can be inlined", a.Name)
+		}
+		a.ContentType = mediaType
+	}
+	return nil
+}
+
+// contentMatches reports whether content detected as sniffed may be of the declared
+// media type. Detection cannot tell text formats apart, so any text/* is taken for
+// text/plain content.
+func contentMatches(declared, sniffed string) bool {
+	if strings.EqualFold(declared, sniffed) {
+		return true
+	}
+	return sniffed == "text/plain" && strings.HasPrefix(strings.ToLower(declared), "text/")
+}
+
+func (l AttachmentLimits) allowed(mediaType string) bool {
+	for _, t := range l.AllowedTypes {
+		if strings.EqualFold(strings.TrimSpace(t), mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// readMultipartMessage reads a multipart/form-data request into a mailMessage. Plain
+// form fields carry the message, "data" may hold the template variables as a JSON
+// object, files in "attachments" are attached and files in "inline" are embedded.
+func (app *Config) readMultipartMessage(w http.ResponseWriter, r *http.Request, msg *mailMessage) error {
+	r.Body = http.MaxBytesReader(w, r.Body, app.Limits.MaxRequestSize())
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		return err
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	msg.From = r.FormValue("from")
+	msg.To = r.MultipartForm.Value["to"]
+	msg.Cc = r.MultipartForm.Value["cc"]
+	msg.Bcc = r.MultipartForm.Value["bcc"]
+	msg.ReplyTo = r.FormValue("reply_to")
+	msg.Subject = r.FormValue("subject")
+	msg.SubjectKey = r.FormValue("subject_key")
+	msg.Message = r.FormValue("message")
+	msg.Template = r.FormValue("template")
+	msg.Locale = r.FormValue("locale")
+	msg.SendAt = r.FormValue("send_at")
+	msg.Timezone = r.FormValue("timezone")
+	if data := r.FormValue("data"); data != "" {
+		if err := json.Unmarshal([]byte(data), &msg.Data); err != nil {
+			return fmt.Errorf("data: %w", err)
+		}
+	}
+	if headers := r.FormValue("headers"); headers != "" {
+		if err := json.Unmarshal([]byte(headers), &msg.Headers); err != nil {
+			return fmt.Errorf("headers: %w", err)
+		}
+	}
+
+	for _, field := range []string{"attachments", "inline"} {
+		for _, fh := range r.MultipartForm.File[field] {
+			a, err := readFormFile(fh, app.Limits.MaxFileSize)
+			if err != nil {
+				return err
+			}
+			a.Inline = field == "inline"
+			msg.Attachments = append(msg.Attachments, a)
+		}
+	}
+	return nil
+}
+
+func readFormFile(fh *multipart.FileHeader, maxSize int64) (Attachment, error) {
+	if fh.Size > maxSize {
+		return Attachment{}, fmt.Errorf("attachment %s is %d bytes, at most %d allowed", fh.Filename, fh.Size, maxSize)
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return Attachment{}, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	// a generic type tells us nothing, let Check detect it from the content
+	contentType := fh.Header.Get("Content-Type")
+	if contentType == "application/octet-stream" {
+		contentType = ""
+	}
+	return Attachment{
+		Name:        fh.Filename,
+		ContentType: contentType,
+		Data:        data,
+	}, nil
+}
+
+// cidURL is available in HTML templates as cid, e.g. <img src="{{cid "logo.png"}}">,
+// and refers to the inline attachment with that name.
+func cidURL(name string) template.URL {
+	return template.URL("cid:" + name)
+}
+
+// isMultipart reports whether the request body is multipart/form-data.
+func isMultipart(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var (
+	pngData = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	pdfData = []byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	exeData = []byte("MZ\x90\x00\x03\x00\x00\x00\x04\x00\x00\x00\xff\xff\x00\x00")
+)
+
+func testLimits() AttachmentLimits {
+	return AttachmentLimits{MaxFileSize: 1 << 20, MaxTotalSize: 1 << 20, MaxFiles: 5, AllowedTypes: defaultAttachmentTypes}
+}
+
+func TestCheckAttachmentContentTypes(t *testing.T) {
+	tests := []struct {
+		name     string
+		declared string
+		data     []byte
+		inline   bool
+		want     string
+		err      string
+	}{
+		{name: "detected", data: pngData, want: "image/png"},
+		{name: "declared", declared: "image/png", data: pngData, want: "image/png"},
+		{name: "parameters", declared: "text/plain; charset=utf-8", data: []byte("hello"), want: "text/plain"},
+		{name: "text format", declared: "text/csv", data: []byte("a,b\n1,2\n"), want: "text/csv"},
+		{name: "inline image", declared: "image/png", data: pngData, inline: true, want: "image/png"},
+		{name: "disguised executable", declared: "application/pdf", data: exeData, err: "declared as application/pdf but its content is application/octet-stream"},
+		{name: "mismatch", declared: "image/png", data: pdfData, err: "declared as image/png but its content is application/pdf"},
+		{name: "text as image", declared: "image/gif", data: []byte("GIF? no"), err: "its content is text/plain"},
+		{name: "unknown content", data: exeData, err: "content type application/octet-stream, which is not allowed"},
+		{name: "declared as allowed type", declared: "text/plain", data: []byte("<html><script>alert(1)</script>"), err: "its content is text/html"},
+		{name: "inline document", declared: "application/pdf", data: pdfData, inline: true, err: "only images can be inlined"},
+		{name: "invalid type", declared: "image/", data: pngData, err: "invalid content type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attachments := []Attachment{{Name: "dir/file", ContentType: tt.declared, Data: tt.data, Inline: tt.inline}}
+			err := testLimits().Check(attachments)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a := attachments[0]; a.ContentType != tt.want || a.Name != "file" {
+				t.Errorf("got %s of type %s", a.Name, a.ContentType)
+			}
+		})
+	}
+}
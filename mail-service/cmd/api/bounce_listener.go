@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// maxBounceSize limits the size of a single message accepted by the bounce listener.
+const maxBounceSize = 10 << 20
+
+// bounceSMTPListen runs a minimal SMTP server that accepts bounce and complaint
+// messages, e.g. when the Return-Path of our mail points at this service. Every message
+// is recorded in the suppression list; anything else is accepted and dropped.
+func (app *Config) bounceSMTPListen(port string) {
+	listen, err := net.Listen("tcp", fmt.Sprintf(":%s", port))
+	if err != nil {
+		log.Println("failed to listen for bounces:", err)
+		return
+	}
+	defer listen.Close()
+	log.Println("listening for bounces via SMTP on port:", port)
+	app.serveBounces(listen)
+}
+
+// serveBounces accepts connections until the listener is closed. Other errors, e.g.
+// running out of file descriptors, are waited out with a growing pause like
+// net/http does.
+func (app *Config) serveBounces(listen net.Listener) {
+	var delay time.Duration
+	for {
+		conn, err := listen.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+			log.Printf("error accepting bounce connection, retrying in %s: %v", delay, err)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go app.serveBounceConn(conn)
+	}
+}
+
+func (app *Config) serveBounceConn(conn net.Conn) {
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+	reply := func(code int, msg string) bool {
+		conn.SetWriteDeadline(time.Now().Add(time.Minute))
+		return tp.PrintfLine("%d %s", code, msg) == nil
+	}
+
+	if !reply(220, "mail-service bounce listener ready") {
+		return
+	}
+
+	hasSender, hasRecipient := false, false
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, _, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(verb) {
+		case "HELO", "EHLO":
+			reply(250, "hello")
+		case "MAIL":
+			hasSender, hasRecipient = true, false
+			reply(250, "ok")
+		case "RCPT":
+			if !hasSender {
+				reply(503, "need MAIL first")
+				continue
+			}
+			hasRecipient = true
+			reply(250, "ok")
+		case "DATA":
+			if !hasRecipient {
+				reply(503, "need RCPT first")
+				continue
+			}
+			reply(354, "end data with <CR><LF>.<CR><LF>")
+
+			dot := tp.DotReader()
+			data, err := io.ReadAll(io.LimitReader(dot, maxBounceSize+1))
+			if err == nil {
+				// the rest of a message that is too large has to be read up to the
+				// final dot all the same, or its lines would be taken for commands
+				_, err = io.Copy(io.Discard, dot)
+			}
+			if err != nil {
+				return
+			}
+			hasSender, hasRecipient = false, false
+			if len(data) > maxBounceSize {
+				reply(552, "message too large")
+				continue
+			}
+			app.processBounce(data)
+			reply(250, "ok")
+		case "RSET":
+			hasSender, hasRecipient = false, false
+			reply(250, "ok")
+		case "NOOP":
+			reply(250, "ok")
+		case "QUIT":
+			reply(221, "bye")
+			return
+		default:
+			reply(502, "command not implemented")
+		}
+	}
+}
+
+// processBounce parses a raw message and records the bounces it reports.
+func (app *Config) processBounce(data []byte) ([]BounceEvent, error) {
+	events, err := ParseBounce(bytes.NewReader(data))
+	if err != nil {
+		log.Println("ignoring inbound message:", err)
+		return nil, err
+	}
+	for _, e := range events {
+		log.Printf("%s bounce for %s: %s %s", e.Type, e.Address, e.Status, e.Diagnostic)
+	}
+	if err := app.Suppressions.Record(events); err != nil {
+		log.Println("error saving suppression list:", err)
+		return nil, err
+	}
+	return events, nil
+}
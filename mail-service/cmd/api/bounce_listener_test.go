@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDSN = "From: MAILER-DAEMON@example.org\r\n" +
+	"To: sender@example.com\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=\"b\"\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Your message could not be delivered.\r\n" +
+	"--b\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.example.org\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; gone@example.org\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"\r\n" +
+	"--b--\r\n"
+
+func newBounceApp(t *testing.T) *Config {
+	t.Helper()
+	suppressions, err := NewSuppressionList(filepath.Join(t.TempDir(), "suppressions.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Config{Suppressions: suppressions, BounceSecret: "webhook-secret"}
+}
+
+func TestBounceListenerDrainsOversizedData(t *testing.T) {
+	app := newBounceApp(t)
+	server, client := net.Pipe()
+	defer client.Close()
+	go app.serveBounceConn(server)
+
+	tp := textproto.NewConn(client)
+	expect := func(cmd string, code int) {
+		t.Helper()
+		if cmd != "" {
+			if err := tp.PrintfLine("%s", cmd); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, msg, err := tp.ReadResponse(code); err != nil {
+			t.Fatalf("%s: %v %s", cmd, err, msg)
+		}
+	}
+	expect("", 220)
+	expect("MAIL FROM:<>", 250)
+	expect("RCPT TO:<bounces@example.com>", 250)
+	expect("DATA", 354)
+
+	w := tp.DotWriter()
+	line := strings.Repeat("x", 998) + "\r\n"
+	// a line that looks like a command must not be taken for one
+	if _, err := w.Write([]byte("QUIT\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 2*maxBounceSize; n += len(line) {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expect("", 552)
+
+	// the session goes on with the next message
+	expect("MAIL FROM:<>", 250)
+	expect("RCPT TO:<bounces@example.com>", 250)
+	expect("DATA", 354)
+	w = tp.DotWriter()
+	w.Write([]byte(testDSN))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expect("", 250)
+	expect("QUIT", 221)
+
+	if !app.Suppressions.IsSuppressed("gone@example.org") {
+		t.Error("the bounce after the oversized message was not recorded")
+	}
+}
+
+func TestReceiveBounceRequiresSecret(t *testing.T) {
+	mac := hmac.New(sha256.New, []byte("webhook-secret"))
+	mac.Write([]byte(testDSN))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		want   int
+	}{
+		{"no credentials", "", "", http.StatusUnauthorized},
+		{"wrong token", "Authorization", "Bearer guess", http.StatusUnauthorized},
+		{"token", "Authorization", "Bearer webhook-secret", http.StatusAccepted},
+		{"wrong signature", "X-Bounce-Signature", "sha256=" + strings.Repeat("0", 64), http.StatusUnauthorized},
+		{"malformed signature", "X-Bounce-Signature", "sha256=xyz", http.StatusUnauthorized},
+		{"signature", "X-Bounce-Signature", signature, http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newBounceApp(t)
+			req := httptest.NewRequest(http.MethodPost, "/bounces", bytes.NewReader([]byte(testDSN)))
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			rec := httptest.NewRecorder()
+			app.ReceiveBounce(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if suppressed := app.Suppressions.IsSuppressed("gone@example.org"); suppressed != (tt.want == http.StatusAccepted) {
+				t.Errorf("suppressed %v after status %d", suppressed, rec.Code)
+			}
+		})
+	}
+}
+
+func TestBounceWebhookNeedsSecret(t *testing.T) {
+	app := newBounceApp(t)
+	app.BounceSecret = ""
+	req := httptest.NewRequest(http.MethodPost, "/bounces", strings.NewReader(testDSN))
+	req.Header.Set("Authorization", "Bearer ")
+	rec := httptest.NewRecorder()
+	app.routes().ServeHTTP(rec, req)
+	if rec.Code == http.StatusAccepted {
+		t.Fatalf("the webhook was served without a secret: %d", rec.Code)
+	}
+}
+
+// flakyListener fails its first Accept calls, then reports being closed.
+type flakyListener struct {
+	net.Listener
+	failures int
+	accepts  int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.accepts++
+	if l.accepts <= l.failures {
+		return nil, errors.New("too many open files")
+	}
+	return nil, net.ErrClosed
+}
+
+func TestServeBouncesStopsWhenClosed(t *testing.T) {
+	app := newBounceApp(t)
+	ln := &flakyListener{failures: 3}
+	done := make(chan struct{})
+	go func() {
+		app.serveBounces(ln)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveBounces kept running after the listener was closed")
+	}
+	if ln.accepts != 4 {
+		t.Errorf("Accept was called %d times, want 4", ln.accepts)
+	}
+}
+
+func TestSuppressionsRequireSecret(t *testing.T) {
+	app := newBounceApp(t)
+	h := app.routes()
+	tests := []struct {
+		name, method, path, token string
+		body                      string
+		want                      int
+	}{
+		{"list without token", http.MethodGet, "/suppressions", "", "", http.StatusUnauthorized},
+		{"add with wrong token", http.MethodPost, "/suppressions", "guess", `{"address": "gone@example.org"}`, http.StatusUnauthorized},
+		{"remove without token", http.MethodDelete, "/suppressions/gone@example.org", "", "", http.StatusUnauthorized},
+		{"list", http.MethodGet, "/suppressions", "webhook-secret", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+	if len(app.Suppressions.All()) != 0 {
+		t.Error("the suppression list was changed without the secret")
+	}
+
+	app.BounceSecret = ""
+	rec := httptest.NewRecorder()
+	app.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/suppressions", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d without a secret, want 404", rec.Code)
+	}
+}
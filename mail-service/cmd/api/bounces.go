@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BounceHard = "hard"
+	BounceSoft = "soft"
+	Complaint  = "complaint"
+	Manual     = "manual"
+)
+
+// ErrNotABounce is returned for messages that are neither a delivery status
+// notification nor a feedback (complaint) report.
+var ErrNotABounce = errors.New("message is not a delivery status notification or complaint")
+
+// BounceEvent is one recipient reported by a DSN (RFC 3464) or a complaint (RFC 5965).
+type BounceEvent struct {
+	Address    string `json:"address"`
+	Type       string `json:"type"`
+	Status     string `json:"status,omitempty"`
+	Action     string `json:"action,omitempty"`
+	Diagnostic string `json:"diagnostic,omitempty"`
+}
+
+// ParseBounce extracts the affected recipients from a raw bounce or complaint message.
+// Recipients that were delivered, relayed or expanded are not returned.
+func ParseBounce(r io.Reader) ([]BounceEvent, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || params["boundary"] == "" {
+		return nil, ErrNotABounce
+	}
+
+	var events []BounceEvent
+	var complaint *BounceEvent
+	var originalTo string
+	isReport := false
+
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		body := io.Reader(part)
+		if strings.EqualFold(part.Header.Get("Content-Transfer-Encoding"), "base64") {
+			body = base64.NewDecoder(base64.StdEncoding, part)
+		}
+
+		switch partType {
+		case "message/delivery-status":
+			isReport = true
+			e, err := parseDeliveryStatus(body)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, e...)
+		case "message/feedback-report":
+			isReport = true
+			c, err := parseFeedbackReport(body)
+			if err != nil {
+				return nil, err
+			}
+			complaint = &c
+		case "message/rfc822", "text/rfc822-headers":
+			// the returned original message tells us who complained if the report doesn't
+			if orig, err := mail.ReadMessage(body); err == nil {
+				originalTo = orig.Header.Get("To")
+			}
+		}
+	}
+
+	if complaint != nil {
+		if complaint.Address == "" {
+			complaint.Address = originalTo
+		}
+		if addr, err := mail.ParseAddress(complaint.Address); err == nil {
+			complaint.Address = strings.ToLower(addr.Address)
+			events = append(events, *complaint)
+		}
+	}
+
+	if !isReport {
+		return nil, ErrNotABounce
+	}
+	return events, nil
+}
+
+// parseDeliveryStatus reads the per-message fields followed by one block of fields per
+// recipient, blocks being separated by blank lines.
+func parseDeliveryStatus(r io.Reader) ([]BounceEvent, error) {
+	tp := textproto.NewReader(bufio.NewReader(r))
+
+	// the first block describes the whole message, which we don't need
+	if _, err := tp.ReadMIMEHeader(); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	var events []BounceEvent
+	for {
+		fields, err := tp.ReadMIMEHeader()
+		if len(fields) > 0 {
+			if e, ok := bounceFromFields(fields); ok {
+				events = append(events, e)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+func bounceFromFields(fields textproto.MIMEHeader) (BounceEvent, bool) {
+	recipient := fields.Get("Final-Recipient")
+	if recipient == "" {
+		recipient = fields.Get("Original-Recipient")
+	}
+	// the field is "address-type; address", e.g. "rfc822; jane@example.com"
+	if i := strings.Index(recipient, ";"); i >= 0 {
+		recipient = recipient[i+1:]
+	}
+	recipient = strings.ToLower(strings.Trim(strings.TrimSpace(recipient), "<>"))
+	if recipient == "" {
+		return BounceEvent{}, false
+	}
+
+	e := BounceEvent{
+		Address:    recipient,
+		Action:     strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+		Status:     strings.TrimSpace(fields.Get("Status")),
+		Diagnostic: strings.TrimSpace(fields.Get("Diagnostic-Code")),
+	}
+	switch {
+	case e.Action == "failed" && strings.HasPrefix(e.Status, "5."):
+		e.Type = BounceHard
+	case e.Action == "failed", e.Action == "delayed":
+		e.Type = BounceSoft
+	default:
+		return BounceEvent{}, false
+	}
+	return e, true
+}
+
+func parseFeedbackReport(r io.Reader) (BounceEvent, error) {
+	fields, err := textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return BounceEvent{}, err
+	}
+	e := BounceEvent{
+		Type:       Complaint,
+		Diagnostic: strings.TrimSpace(fields.Get("Feedback-Type")),
+	}
+	if rcpt := fields.Get("Original-Rcpt-To"); rcpt != "" {
+		e.Address = strings.Trim(strings.TrimSpace(rcpt), "<>")
+	}
+	return e, nil
+}
+
+// Suppression is what we know about the deliverability of one address.
+type Suppression struct {
+	Address     string    `json:"address"`
+	Suppressed  bool      `json:"suppressed"`
+	Reason      string    `json:"reason,omitempty"`
+	HardBounces int       `json:"hard_bounces"`
+	SoftBounces int       `json:"soft_bounces"`
+	Complaints  int       `json:"complaints"`
+	LastStatus  string    `json:"last_status,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// SuppressionList records bounces and complaints per address and keeps mail away from
+// addresses that hard-bounced or complained. It is persisted to a single JSON file.
+type SuppressionList struct {
+	file    string
+	mu      sync.RWMutex
+	entries map[string]*Suppression
+}
+
+// NewSuppressionList loads the list from file, starting empty if it doesn't exist yet.
+func NewSuppressionList(file string) (*SuppressionList, error) {
+	l := &SuppressionList{
+		file:    file,
+		entries: make(map[string]*Suppression),
+	}
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, os.MkdirAll(filepath.Dir(file), 0o755)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []*Suppression
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		l.entries[e.Address] = e
+	}
+	return l, nil
+}
+
+// Record adds bounce events to the list. Hard bounces and complaints suppress the
+// address, soft bounces are only counted.
+func (l *SuppressionList) Record(events []BounceEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, e := range events {
+		s := l.entry(e.Address)
+		switch e.Type {
+		case BounceHard:
+			s.HardBounces++
+			s.Suppressed = true
+			s.Reason = BounceHard
+		case BounceSoft:
+			s.SoftBounces++
+		case Complaint:
+			s.Complaints++
+			s.Suppressed = true
+			s.Reason = Complaint
+		}
+		s.LastStatus = e.Status
+		s.LastError = e.Diagnostic
+		s.UpdatedAt = time.Now()
+	}
+	return l.save()
+}
+
+// Suppress adds an address to the list by hand.
+func (l *SuppressionList) Suppress(address, reason string) (Suppression, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if reason == "" {
+		reason = Manual
+	}
+	s := l.entry(address)
+	s.Suppressed = true
+	s.Reason = reason
+	s.UpdatedAt = time.Now()
+	return *s, l.save()
+}
+
+// Remove forgets everything about an address, allowing mail to it again.
+func (l *SuppressionList) Remove(address string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	address = strings.ToLower(address)
+	if _, ok := l.entries[address]; !ok {
+		return false, nil
+	}
+	delete(l.entries, address)
+	return true, l.save()
+}
+
+// Get returns the entry for an address.
+func (l *SuppressionList) Get(address string) (Suppression, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	s, ok := l.entries[strings.ToLower(address)]
+	if !ok {
+		return Suppression{}, false
+	}
+	return *s, true
+}
+
+// All returns every known address, sorted.
+func (l *SuppressionList) All() []Suppression {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	all := make([]Suppression, 0, len(l.entries))
+	for _, s := range l.entries {
+		all = append(all, *s)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Address < all[j].Address })
+	return all
+}
+
+// IsSuppressed reports whether mail to address must not be sent.
+func (l *SuppressionList) IsSuppressed(address string) bool {
+	s, ok := l.Get(address)
+	return ok && s.Suppressed
+}
+
+// Filter removes suppressed addresses from the recipients of msg and returns them.
+func (l *SuppressionList) Filter(msg *Message) []string {
+	var removed []string
+	keep := func(list AddressList) AddressList {
+		var out AddressList
+		for _, a := range list {
+			addr, err := mail.ParseAddress(a)
+			if err == nil && l.IsSuppressed(addr.Address) {
+				removed = append(removed, addr.Address)
+				continue
+			}
+			out = append(out, a)
+		}
+		return out
+	}
+	msg.To = keep(msg.To)
+	msg.Cc = keep(msg.Cc)
+	msg.Bcc = keep(msg.Bcc)
+	return removed
+}
+
+func (l *SuppressionList) entry(address string) *Suppression {
+	address = strings.ToLower(address)
+	s, ok := l.entries[address]
+	if !ok {
+		s = &Suppression{Address: address}
+		l.entries[address] = s
+	}
+	return s
+}
+
+// save writes the whole list, going through a temporary file so it is never half written.
+func (l *SuppressionList) save() error {
+	all := make([]*Suppression, 0, len(l.entries))
+	for _, s := range l.entries {
+		all = append(all, s)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Address < all[j].Address })
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(all); err != nil {
+		return err
+	}
+	tmp := l.file + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.file)
+}
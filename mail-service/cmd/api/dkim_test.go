@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toorop/go-dkim"
+)
+
+// smtpStub is a mail server that accepts every message and keeps its data.
+type smtpStub struct {
+	ln       net.Listener
+	messages chan []byte
+}
+
+func newSMTPStub(t *testing.T) *smtpStub {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStub{ln: ln, messages: make(chan []byte, 10)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStub) addr() (string, int) {
+	a := s.ln.Addr().(*net.TCPAddr)
+	return a.IP.String(), a.Port
+}
+
+func (s *smtpStub) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 stub ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch verb {
+		case "EHLO":
+			reply("250-stub")
+			reply("250 8BITMIME")
+		case "DATA":
+			reply("354 go ahead")
+			var data bytes.Buffer
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			s.messages <- data.Bytes()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// received returns the next message the stub accepted.
+func (s *smtpStub) received(t *testing.T) []byte {
+	t.Helper()
+	select {
+	case msg := <-s.messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message was received")
+		return nil
+	}
+}
+
+// newDKIMKey returns a private key in PEM and the DNS record publishing its public key.
+func newDKIMKey(t *testing.T) ([]byte, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return private, "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(public)
+}
+
+func TestDKIMSignatureVerifies(t *testing.T) {
+	private, record := newDKIMKey(t)
+	lookupTXT := dkim.DNSOptLookupTXT(func(name string) ([]string, error) {
+		if name != "mail._domainkey.example.com" {
+			return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		return []string{record}, nil
+	})
+
+	for _, canonicalization := range []string{"relaxed/relaxed", "simple/simple"} {
+		t.Run(canonicalization, func(t *testing.T) {
+			signer, err := NewDKIMSigner(private, "example.com", "mail", canonicalization, defaultDKIMHeaders)
+			if err != nil {
+				t.Fatal(err)
+			}
+			templates, err := NewTemplateRegistry("../../templates")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stub := newSMTPStub(t)
+			m := Mail{FromAddress: "sender@example.com", Templates: templates, DKIM: signer, Encryption: "none"}
+			m.Host, m.Port = stub.addr()
+			pool := NewSMTPPool(m.SMTPServer(), 1, time.Minute)
+			defer pool.Close()
+			m.Transport = &SMTPTransport{Pool: pool}
+
+			err = m.SendMessage(Message{
+				To:       AddressList{"rcpt@example.org"},
+				Subject:  "Signed",
+				Template: "mail",
+				Data:     "Hello there",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msg := stub.received(t)
+			if !bytes.HasPrefix(msg, []byte("DKIM-Signature:")) {
+				t.Fatalf("message is not signed:\n%s", msg)
+			}
+			if status, err := dkim.Verify(&msg, lookupTXT); status != dkim.SUCCESS {
+				t.Fatalf("verification failed: %v (status %d)", err, status)
+			}
+
+			tampered := bytes.Replace(msg, []byte("Hello there"), []byte("Hello thief"), 1)
+			if bytes.Equal(tampered, msg) {
+				t.Fatal("the body was not found in the message")
+			}
+			if status, _ := dkim.Verify(&tampered, lookupTXT); status == dkim.SUCCESS {
+				t.Fatal("a message with a tampered body verified")
+			}
+		})
+	}
+}
+
+func TestNewDKIMSignerRejectsBadSettings(t *testing.T) {
+	private, _ := newDKIMKey(t)
+	if _, err := NewDKIMSigner([]byte("not a key"), "example.com", "mail", "relaxed/relaxed", defaultDKIMHeaders); err == nil {
+		t.Error("an invalid key was accepted")
+	}
+	if _, err := NewDKIMSigner(private, "example.com", "mail", "loose/loose", defaultDKIMHeaders); err == nil {
+		t.Error("an invalid canonicalization was accepted")
+	}
+}
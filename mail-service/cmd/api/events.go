@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"sync"
+	"time"
+	"toolbox/jsonutil"
+	"toolbox/tracing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// mailExchange is the topic exchange shared with the broker and the listener.
+	mailExchange = "logs_topic"
+	// mailQueueName is durable, so mail published while we are down is not lost.
+	mailQueueName = "mail"
+
+	mailTopics    = "mail.*"
+	mailSendKey   = "mail.send"
+	mailSentKey   = "mail.sent"
+	mailFailedKey = "mail.failed"
+)
+
+// queuedMailRequest is the body of a mail.send event: a mail request as accepted by
+// /send, plus the tracking ID the publisher already handed to its client.
+type queuedMailRequest struct {
+	ID string `json:"id"`
+	mailMessage
+}
+
+// MailEvent is published on mail.sent or mail.failed once a message is done.
+type MailEvent struct {
+	ID       string      `json:"id"`
+	Status   string      `json:"status"`
+	To       AddressList `json:"to"`
+	Subject  string      `json:"subject"`
+	Attempts int         `json:"attempts"`
+	Error    string      `json:"error,omitempty"`
+	At       time.Time   `json:"at"`
+}
+
+// MailEvents connects mail-service to RabbitMQ: it consumes mail.send requests and
+// publishes the outcome of every message.
+type MailEvents struct {
+	URL string
+
+	mu      sync.Mutex
+	channel *amqp.Channel
+}
+
+// Publish sends the result of qm on mail.sent or mail.failed. Results are dropped
+// while RabbitMQ is unreachable; the status endpoint still has them.
+func (e *MailEvents) Publish(qm QueuedMessage) {
+	key := mailSentKey
+	if qm.Status != StatusSent {
+		key = mailFailedKey
+	}
+	body, err := json.Marshal(MailEvent{
+		ID:       qm.ID,
+		Status:   qm.Status,
+		To:       qm.Message.To,
+		Subject:  qm.Message.Subject,
+		Attempts: qm.Attempts,
+		Error:    qm.LastError,
+		At:       qm.UpdatedAt,
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.channel == nil {
+		log.Printf("not connected to RabbitMQ, dropping %s event for %s", key, qm.ID)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx, span, headers := tracing.StartPublish(ctx, mailExchange, key)
+	defer func() { tracing.End(span, err) }()
+	err = e.channel.PublishWithContext(ctx, mailExchange, key, false, false, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    qm.ID,
+		Timestamp:    time.Now(),
+		Body:         body,
+	})
+	if err != nil {
+		log.Printf("error publishing %s event for %s: %v", key, qm.ID, err)
+	}
+}
+
+// listenForMail consumes mail requests from RabbitMQ, reconnecting whenever the
+// connection is lost.
+func (app *Config) listenForMail() {
+	for {
+		conn, err := connectRabbit(app.Events.URL)
+		if err != nil {
+			log.Println(err)
+			time.Sleep(30 * time.Second)
+			continue
+		}
+		err = app.consumeMail(conn)
+		log.Println("stopped consuming mail requests:", err)
+		conn.Close()
+		time.Sleep(time.Second)
+	}
+}
+
+func (app *Config) consumeMail(conn *amqp.Connection) error {
+	publish, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	err = ch.ExchangeDeclare(mailExchange, "topic", true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	q, err := ch.QueueDeclare(mailQueueName, true, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	if err := ch.QueueBind(q.Name, mailTopics, mailExchange, false, nil); err != nil {
+		return err
+	}
+	// only take as many requests as the queue workers can keep up with
+	if err := ch.Qos(app.Queue.Workers*2, 0, false); err != nil {
+		return err
+	}
+	deliveries, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	app.Events.mu.Lock()
+	app.Events.channel = publish
+	app.Events.mu.Unlock()
+	defer func() {
+		app.Events.mu.Lock()
+		app.Events.channel = nil
+		app.Events.mu.Unlock()
+	}()
+
+	log.Printf("consuming mail requests [Exchange, Queue][%s,%s]", mailExchange, q.Name)
+	for d := range deliveries {
+		_, span := tracing.StartConsume(mailExchange, d.RoutingKey, d.Headers)
+		app.handleMailDelivery(d)
+		span.End()
+	}
+	return errors.New("delivery channel closed")
+}
+
+// handleMailDelivery queues one mail.send request. Requests that can never succeed are
+// recorded as failed and acknowledged; only storage errors are retried.
+func (app *Config) handleMailDelivery(d amqp.Delivery) {
+	switch d.RoutingKey {
+	case mailSendKey:
+	case mailSentKey, mailFailedKey:
+		// our own results, they match mail.* as well
+		d.Ack(false)
+		return
+	default:
+		log.Println("ignoring mail event with unknown routing key:", d.RoutingKey)
+		d.Nack(false, false)
+		return
+	}
+
+	var request queuedMailRequest
+	if err := json.Unmarshal(d.Body, &request); err != nil {
+		log.Println("dropping malformed mail request:", err)
+		d.Nack(false, false)
+		return
+	}
+	if err := jsonutil.Validate(request.mailMessage); err != nil {
+		log.Println("dropping invalid mail request:", err)
+		d.Nack(false, false)
+		return
+	}
+	id, err := messageID(request.ID)
+	if err != nil {
+		log.Printf("dropping mail request with ID %q: %v", request.ID, err)
+		d.Nack(false, false)
+		return
+	}
+
+	qm, err := app.queueMailRequest(id, request.mailMessage)
+	switch {
+	case errors.Is(err, ErrDuplicateMessage):
+		// redelivered after we stored it, nothing left to do
+		d.Ack(false)
+	case err != nil:
+		log.Println("error queueing mail request", id, err)
+		d.Nack(false, true)
+	default:
+		log.Printf("mail request %s is %s", qm.ID, qm.Status)
+		d.Ack(false)
+	}
+}
+
+// queueMailRequest queues or schedules a request received from RabbitMQ. There is no
+// client waiting for an answer, so an invalid or throttled request is stored as failed.
+// As on /send, scheduled mail is only charged when it goes out.
+func (app *Config) queueMailRequest(id string, request mailMessage) (QueuedMessage, error) {
+	msg, err := app.toMessage(request)
+	var at time.Time
+	if err == nil && request.SendAt != "" {
+		at, err = sendTime(request.SendAt, request.Timezone)
+	} else if err == nil {
+		err = app.RateLimiter.Allow(app.Mailer.sender(msg), msg)
+	}
+	if err != nil {
+		if msg.To == nil {
+			msg.To, msg.Subject = request.To, request.Subject
+		}
+		return app.Queue.Reject(id, msg, err)
+	}
+
+	if request.SendAt != "" {
+		return app.Queue.Schedule(id, msg, at, request.Timezone)
+	}
+	return app.Queue.Enqueue(id, msg)
+}
+
+// connectRabbit dials RabbitMQ, backing off while it is starting up.
+func connectRabbit(url string) (*amqp.Connection, error) {
+	var counts int64
+	for {
+		c, err := amqp.Dial(url)
+		if err == nil {
+			log.Println("Connected to RabbitMQ")
+			return c, nil
+		}
+		log.Println("RabbitMQ not yet ready...")
+		counts++
+		if counts > 5 {
+			return nil, err
+		}
+		backOff := time.Duration(math.Pow(float64(counts), 2)) * time.Second
+		log.Println("backing off...")
+		time.Sleep(backOff)
+	}
+}
@@ -1,39 +1,476 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+	"toolbox/jsonutil"
+
+	"github.com/go-chi/chi/v5"
 )
 
-func (app *Config) SendMail(w http.ResponseWriter, r *http.Request) {
-	type mailMessage struct {
-		From    string `json:"from"`
-		To      string `json:"to"`
-		Subject string `json:"subject"`
-		Message string `json:"message"`
+type mailMessage struct {
+	From        string            `json:"from" validate:"email"`
+	To          AddressList       `json:"to" validate:"required,email"`
+	Cc          AddressList       `json:"cc,omitempty" validate:"email"`
+	Bcc         AddressList       `json:"bcc,omitempty" validate:"email"`
+	ReplyTo     string            `json:"reply_to,omitempty" validate:"email"`
+	Headers     map[string]string `json:"headers,omitempty" validate:"max=50"`
+	Subject     string            `json:"subject" validate:"max=998"`
+	SubjectKey  string            `json:"subject_key,omitempty" validate:"max=100"`
+	Message     string            `json:"message"`
+	Template    string            `json:"template,omitempty" validate:"max=100"`
+	Locale      string            `json:"locale,omitempty" validate:"max=35"`
+	Data        map[string]any    `json:"data,omitempty"`
+	Attachments []Attachment      `json:"attachments,omitempty"`
+	SendAt      string            `json:"send_at,omitempty" validate:"max=64"`
+	Timezone    string            `json:"timezone,omitempty" validate:"max=64"`
+}
+
+// suppressionRequest is the body of AddSuppression.
+type suppressionRequest struct {
+	Address string `json:"address" validate:"required,email"`
+	Reason  string `json:"reason" validate:"oneof=hard soft complaint manual"`
+}
+
+func init() {
+	// a mistyped validation rule stops the service here rather than failing requests
+	jsonutil.MustCheckTags(mailMessage{}, suppressionRequest{})
+}
+
+// readMailMessage reads a message sent either as JSON or as multipart/form-data.
+func (app *Config) readMailMessage(w http.ResponseWriter, r *http.Request, msg *mailMessage) error {
+	if isMultipart(r) {
+		if err := app.readMultipartMessage(w, r, msg); err != nil {
+			return err
+		}
+		// JSON bodies are validated as they are read
+		return jsonutil.Validate(msg)
+	}
+	return app.JSON.ReadJSON(w, r, msg)
+}
+
+// toMessage converts the request into a Message, rejecting unknown templates, attachments
+// over the limits and invalid recipients.
+func (app *Config) toMessage(requestPayload mailMessage) (Message, error) {
+	if !app.Mailer.Templates.Has(requestPayload.Template) {
+		return Message{}, fmt.Errorf("unknown template: %s", requestPayload.Template)
+	}
+	if requestPayload.Locale != "" && !validLocale(requestPayload.Locale) {
+		return Message{}, fmt.Errorf("invalid locale: %s", requestPayload.Locale)
+	}
+	if err := app.Limits.Check(requestPayload.Attachments); err != nil {
+		return Message{}, err
+	}
+	msg := Message{
+		From:        requestPayload.From,
+		To:          requestPayload.To,
+		Cc:          requestPayload.Cc,
+		Bcc:         requestPayload.Bcc,
+		ReplyTo:     requestPayload.ReplyTo,
+		Headers:     requestPayload.Headers,
+		Subject:     requestPayload.Subject,
+		Template:    requestPayload.Template,
+		Locale:      requestPayload.Locale,
+		Data:        requestPayload.Message,
+		DataMap:     requestPayload.Data,
+		Attachments: requestPayload.Attachments,
+	}
+	if err := checkRecipients(&msg, app.MaxRecipients); err != nil {
+		return Message{}, err
+	}
+
+	// subject_key names a subject of the catalogs, subject is used as it is; without
+	// either the template name is tried as a key
+	key, required := requestPayload.SubjectKey, true
+	if key == "" && msg.Subject == "" {
+		key, required = msg.Template, false
+		if key == "" {
+			key = defaultTemplate
+		}
+	}
+	if key != "" {
+		subject, ok, err := app.Mailer.Templates.Subject(key, msg.Locale, app.Mailer.templateData(msg))
+		if err != nil {
+			return Message{}, err
+		}
+		if !ok && required {
+			invalid := jsonutil.NewError(http.StatusUnprocessableEntity, "", "unknown subject key: "+key)
+			invalid.Fields = []jsonutil.FieldError{{Field: "subject_key", Code: "unknown", Message: "is not in the subject catalogs"}}
+			return Message{}, invalid
+		}
+		if ok {
+			msg.Subject = subject
+		}
 	}
+	if removed := app.Suppressions.Filter(&msg); len(removed) > 0 {
+		log.Println("not sending to suppressed addresses:", strings.Join(removed, ", "))
+		if recipientCount(msg) == 0 {
+			return Message{}, errors.New("all recipients are on the suppression list")
+		}
+	}
+	return msg, nil
+}
+
+func (app *Config) SendMail(w http.ResponseWriter, r *http.Request) {
 	var requestPayload mailMessage
-	err := app.readJSON(w, r, &requestPayload)
+	err := app.readMailMessage(w, r, &requestPayload)
 	if err != nil {
 		log.Println(err)
-		app.errorJSON(w, err)
+		app.JSON.ErrorJSON(w, err)
 		return
 	}
-	msg := Message{
-		From:    requestPayload.From,
-		To:      requestPayload.To,
-		Subject: requestPayload.Subject,
-		Data:    requestPayload.Message,
+	msg, err := app.toMessage(requestPayload)
+	if err != nil {
+		app.JSON.ErrorJSON(w, err)
+		return
+	}
+	if requestPayload.SendAt != "" {
+		// scheduled mail is charged when it goes out
+		app.scheduleMail(w, msg, requestPayload.SendAt, requestPayload.Timezone)
+		return
+	}
+	if !app.allowSend(w, msg) {
+		return
+	}
+	qm, err := app.Queue.Enqueue("", msg)
+	if err != nil {
+		log.Println(err)
+		app.JSON.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	payload := jsonutil.Response{
+		Error:   false,
+		Message: "queued for " + msg.To.String(),
+		Data:    newMessageStatus(qm),
+	}
+	app.JSON.WriteJSON(w, http.StatusAccepted, payload)
+}
+
+// allowSend checks msg against the rate limits and answers 429 with a Retry-After
+// header when it has to wait.
+func (app *Config) allowSend(w http.ResponseWriter, msg Message) bool {
+	err := app.RateLimiter.Allow(app.Mailer.sender(msg), msg)
+	var limited *RateLimitError
+	if errors.As(err, &limited) {
+		log.Println("throttled:", err)
+		seconds := int(math.Ceil(limited.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		app.JSON.ErrorJSON(w, err, http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// RateLimitMetrics reports how many messages were allowed and throttled per limit.
+func (app *Config) RateLimitMetrics(w http.ResponseWriter, r *http.Request) {
+	payload := jsonutil.Response{
+		Error:   false,
+		Message: "rate limit metrics",
+		Data:    app.RateLimiter.Metrics(),
 	}
-	err = app.Mailer.SendSMTPMessage(msg)
+	app.JSON.WriteJSON(w, http.StatusOK, payload)
+}
+
+func (app *Config) scheduleMail(w http.ResponseWriter, msg Message, sendAt, timezone string) {
+	at, err := sendTime(sendAt, timezone)
+	if err != nil {
+		app.JSON.ErrorJSON(w, err)
+		return
+	}
+	qm, err := app.Queue.Schedule("", msg, at, timezone)
 	if err != nil {
 		log.Println(err)
-		app.errorJSON(w, err)
+		app.JSON.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	payload := jsonutil.Response{
+		Error:   false,
+		Message: fmt.Sprintf("scheduled for %s at %s", msg.To, at.Format(time.RFC3339)),
+		Data:    newMessageStatus(qm),
+	}
+	app.JSON.WriteJSON(w, http.StatusAccepted, payload)
+}
+
+// ListScheduled returns all messages that are waiting for their send time.
+func (app *Config) ListScheduled(w http.ResponseWriter, r *http.Request) {
+	scheduled := app.Queue.Scheduled()
+	list := make([]messageStatus, 0, len(scheduled))
+	for _, qm := range scheduled {
+		list = append(list, newMessageStatus(qm))
+	}
+	payload := jsonutil.Response{
+		Error:   false,
+		Message: fmt.Sprintf("%d scheduled messages", len(list)),
+		Data:    list,
+	}
+	app.JSON.WriteJSON(w, http.StatusOK, payload)
+}
+
+// CancelScheduled cancels a message that has not been sent yet.
+func (app *Config) CancelScheduled(w http.ResponseWriter, r *http.Request) {
+	qm, err := app.Queue.Cancel(chi.URLParam(r, "id"))
+	if errors.Is(err, ErrMessageNotFound) {
+		app.JSON.ErrorJSON(w, err, http.StatusNotFound)
+		return
+	} else if errors.Is(err, ErrNotScheduled) {
+		app.JSON.ErrorJSON(w, err, http.StatusConflict)
+		return
+	} else if err != nil {
+		app.JSON.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	payload := jsonutil.Response{
+		Error:   false,
+		Message: "cancelled",
+		Data:    newMessageStatus(qm),
+	}
+	app.JSON.WriteJSON(w, http.StatusOK, payload)
+}
+
+// messageStatus is the public view of a queued message.
+type messageStatus struct {
+	ID          string      `json:"id"`
+	Status      string      `json:"status"`
+	To          AddressList `json:"to"`
+	Subject     string      `json:"subject"`
+	Attempts    int         `json:"attempts"`
+	LastError   string      `json:"last_error,omitempty"`
+	NextAttempt *time.Time  `json:"next_attempt,omitempty"`
+	SendAt      *time.Time  `json:"send_at,omitempty"`
+	Timezone    string      `json:"timezone,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+}
+
+func newMessageStatus(qm QueuedMessage) messageStatus {
+	status := messageStatus{
+		ID:        qm.ID,
+		Status:    qm.Status,
+		To:        qm.Message.To,
+		Subject:   qm.Message.Subject,
+		Attempts:  qm.Attempts,
+		LastError: qm.LastError,
+		SendAt:    qm.SendAt,
+		Timezone:  qm.Timezone,
+		CreatedAt: qm.CreatedAt,
+		UpdatedAt: qm.UpdatedAt,
+	}
+	if qm.Status == StatusQueued {
+		status.NextAttempt = &qm.NextAttempt
+	}
+	return status
+}
+
+// MessageStatus reports whether a message is scheduled, queued, sent, failed or cancelled.
+func (app *Config) MessageStatus(w http.ResponseWriter, r *http.Request) {
+	qm, err := app.Queue.Status(chi.URLParam(r, "id"))
+	if err != nil {
+		app.JSON.ErrorJSON(w, err, http.StatusNotFound)
+		return
+	}
+	payload := jsonutil.Response{
+		Error:   false,
+		Message: qm.Status,
+		Data:    newMessageStatus(qm),
+	}
+	app.JSON.WriteJSON(w, http.StatusOK, payload)
+}
+
+// PreviewMail renders the requested template with the supplied data and returns
+// the result instead of sending it.
+func (app *Config) PreviewMail(w http.ResponseWriter, r *http.Request) {
+	var requestPayload mailMessage
+	err := app.readMailMessage(w, r, &requestPayload)
+	if err != nil {
+		app.JSON.ErrorJSON(w, err)
+		return
+	}
+	msg, err := app.toMessage(requestPayload)
+	if err != nil {
+		app.JSON.ErrorJSON(w, err)
+		return
+	}
+	html, plain, err := app.Mailer.Preview(msg)
+	if err != nil {
+		app.JSON.ErrorJSON(w, err)
+		return
+	}
+	payload := jsonutil.Response{
+		Error:   false,
+		Message: "rendered " + msg.Template,
+		Data: map[string]string{
+			"subject": msg.Subject,
+			"html":    html,
+			"plain":   plain,
+		},
+	}
+	app.JSON.WriteJSON(w, http.StatusOK, payload)
+}
+
+// ListTemplates returns the names of all templates that can be used in /send.
+func (app *Config) ListTemplates(w http.ResponseWriter, r *http.Request) {
+	payload := jsonutil.Response{
+		Error:   false,
+		Message: "templates",
+		Data:    app.Mailer.Templates.Names(),
+	}
+	app.JSON.WriteJSON(w, http.StatusOK, payload)
+}
+
+// ReceiveBounce is a webhook for providers that forward bounce and complaint messages
+// over HTTP. The body is the raw message. Bounces take addresses off our mailing, so
+// providers have to prove they know BounceSecret: either as a Bearer token, or with
+// the hex HMAC-SHA256 of the body under it in X-Bounce-Signature ("sha256=...").
+func (app *Config) ReceiveBounce(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBounceSize)
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		app.JSON.ErrorJSON(w, err)
+		return
+	}
+	if !app.bounceAuthorized(r, data) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="bounces"`)
+		app.JSON.ErrorJSON(w, errors.New("invalid bounce webhook credentials"), http.StatusUnauthorized)
+		return
+	}
+	events, err := app.processBounce(data)
+	if errors.Is(err, ErrNotABounce) {
+		app.JSON.ErrorJSON(w, err, http.StatusUnprocessableEntity)
+		return
+	} else if err != nil {
+		app.JSON.ErrorJSON(w, err)
+		return
+	}
+	payload := jsonutil.Response{
+		Error:   false,
+		Message: fmt.Sprintf("recorded %d bounces", len(events)),
+		Data:    events,
+	}
+	app.JSON.WriteJSON(w, http.StatusAccepted, payload)
+}
+
+// bounceAuthorized checks the token or the signature of a bounce webhook request.
+func (app *Config) bounceAuthorized(r *http.Request, body []byte) bool {
+	if app.BounceSecret == "" {
+		return false
+	}
+	if valid, sent := app.bearerSecret(r); sent {
+		return valid
+	}
+	signature, ok := strings.CutPrefix(r.Header.Get("X-Bounce-Signature"), "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(app.BounceSecret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// bearerSecret checks BounceSecret sent as a Bearer token. sent is false when r has no
+// Bearer token at all.
+func (app *Config) bearerSecret(r *http.Request) (valid, sent bool) {
+	token, sent := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !sent || app.BounceSecret == "" {
+		return false, sent
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(app.BounceSecret)) == 1, true
+}
+
+// requireSecret only lets requests carrying BounceSecret as a Bearer token through to
+// next. The suppression list decides who gets our mail, just like the bounces filling it.
+func (app *Config) requireSecret(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if valid, _ := app.bearerSecret(r); !valid {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="suppressions"`)
+			app.JSON.ErrorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ListSuppressions returns every address with recorded bounces or complaints.
+func (app *Config) ListSuppressions(w http.ResponseWriter, r *http.Request) {
+	payload := jsonutil.Response{
+		Error:   false,
+		Message: "suppressions",
+		Data:    app.Suppressions.All(),
+	}
+	app.JSON.WriteJSON(w, http.StatusOK, payload)
+}
+
+// GetSuppression returns what is known about one address.
+func (app *Config) GetSuppression(w http.ResponseWriter, r *http.Request) {
+	s, ok := app.Suppressions.Get(chi.URLParam(r, "address"))
+	if !ok {
+		app.JSON.ErrorJSON(w, errors.New("address not found"), http.StatusNotFound)
+		return
+	}
+	payload := jsonutil.Response{
+		Error:   false,
+		Message: s.Address,
+		Data:    s,
+	}
+	app.JSON.WriteJSON(w, http.StatusOK, payload)
+}
+
+// AddSuppression stops mail to an address by hand.
+func (app *Config) AddSuppression(w http.ResponseWriter, r *http.Request) {
+	var requestPayload suppressionRequest
+	err := app.JSON.ReadJSON(w, r, &requestPayload)
+	if err != nil {
+		app.JSON.ErrorJSON(w, err)
+		return
+	}
+	addr, err := mail.ParseAddress(requestPayload.Address)
+	if err != nil {
+		app.JSON.ErrorJSON(w, fmt.Errorf("invalid address %q", requestPayload.Address))
+		return
+	}
+	s, err := app.Suppressions.Suppress(addr.Address, requestPayload.Reason)
+	if err != nil {
+		app.JSON.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	payload := jsonutil.Response{
+		Error:   false,
+		Message: "suppressed " + s.Address,
+		Data:    s,
+	}
+	app.JSON.WriteJSON(w, http.StatusCreated, payload)
+}
+
+// RemoveSuppression allows mail to an address again.
+func (app *Config) RemoveSuppression(w http.ResponseWriter, r *http.Request) {
+	address := chi.URLParam(r, "address")
+	found, err := app.Suppressions.Remove(address)
+	if err != nil {
+		app.JSON.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		app.JSON.ErrorJSON(w, errors.New("address not found"), http.StatusNotFound)
 		return
 	}
-	payload := jsonResponce{
+	payload := jsonutil.Response{
 		Error:   false,
-		Message: "sent to" + requestPayload.To,
+		Message: "removed " + address,
 	}
-	app.writeJSON(w, http.StatusAccepted, payload)
+	app.JSON.WriteJSON(w, http.StatusOK, payload)
 }
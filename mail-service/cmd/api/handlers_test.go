@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"toolbox/jsonutil"
+)
+
+func newMailApp(t *testing.T) *Config {
+	t.Helper()
+	templates, err := NewTemplateRegistry("../../templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	suppressions, err := NewSuppressionList(filepath.Join(t.TempDir(), "suppressions.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Config{
+		Mailer:        Mail{FromAddress: "sender@example.com", Templates: templates},
+		Limits:        createAttachmentLimits(),
+		Suppressions:  suppressions,
+		MaxRecipients: 50,
+	}
+}
+
+func TestSubjectKey(t *testing.T) {
+	app := newMailApp(t)
+	tests := []struct {
+		name    string
+		request mailMessage
+		want    string
+	}{
+		{"key", mailMessage{SubjectKey: "welcome", Template: "welcome"}, "Welcome, Ana!"},
+		{"translated key", mailMessage{SubjectKey: "welcome", Template: "welcome", Locale: "de-AT"}, "Willkommen, Ana!"},
+		{"key over subject", mailMessage{SubjectKey: "alert", Subject: "Hello"}, "Alert"},
+		{"literal subject", mailMessage{Subject: "welcome", Template: "welcome"}, "welcome"},
+		{"template name", mailMessage{Template: "password-reset", Locale: "de"}, "Passwort zurücksetzen"},
+		{"no subject", mailMessage{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.request.To = AddressList{"rcpt@example.org"}
+			tt.request.Data = map[string]any{"name": "Ana"}
+			msg, err := app.toMessage(tt.request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Subject != tt.want {
+				t.Errorf("got subject %q, want %q", msg.Subject, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnknownSubjectKey(t *testing.T) {
+	app := newMailApp(t)
+	_, err := app.toMessage(mailMessage{To: AddressList{"rcpt@example.org"}, SubjectKey: "welcom", Subject: "Welcome"})
+	var invalid *jsonutil.Error
+	if !errors.As(err, &invalid) || invalid.Status != http.StatusUnprocessableEntity {
+		t.Fatalf("got error %v, want 422", err)
+	}
+	if len(invalid.Fields) != 1 || invalid.Fields[0].Field != "subject_key" {
+		t.Errorf("got fields %+v", invalid.Fields)
+	}
+}
+
+func TestSuppressedRecipients(t *testing.T) {
+	app := newMailApp(t)
+	if _, err := app.Suppressions.Suppress("gone@example.org", "hard bounce"); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := app.toMessage(mailMessage{To: AddressList{"gone@example.org"}, Cc: AddressList{"cc@example.org"}, Subject: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.To) != 0 || len(msg.Cc) != 1 {
+		t.Errorf("got to %v and cc %v", msg.To, msg.Cc)
+	}
+	if _, err := app.toMessage(mailMessage{To: AddressList{"gone@example.org"}, Subject: "Hello"}); err == nil {
+		t.Error("a message without any recipient left was accepted")
+	}
+
+	// a message left with cc recipients only can still be sent
+	transport, err := NewFileTransport(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Mailer.Transport = transport
+	if err := app.Mailer.SendMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSendMailIsThrottled(t *testing.T) {
+	app := newMailApp(t)
+	store, err := NewQueueStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Queue = &MailQueue{Store: store}
+	app.RateLimiter = &RateLimiter{
+		Recipient: NewKeyedLimiter(Rate{Count: 1, Period: time.Minute}),
+		throttled: make(map[string]int64),
+	}
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		app.SendMail(rec, req)
+		return rec
+	}
+
+	if rec := send(`{"to": "rcpt@example.org", "subject": "Hello"}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body)
+	}
+	rec := send(`{"to": "rcpt@example.org", "subject": "Hello"}`)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want 429: %s", rec.Code, rec.Body)
+	}
+	if retry, err := strconv.Atoi(rec.Header().Get("Retry-After")); err != nil || retry < 1 || retry > 60 {
+		t.Errorf("got Retry-After %q", rec.Header().Get("Retry-After"))
+	}
+	if n := len(store.List(StatusQueued)); n != 1 {
+		t.Errorf("%d messages were queued, want 1", n)
+	}
+
+	// scheduled mail waits for the limits in the queue instead
+	if rec := send(`{"to": "rcpt@example.org", "subject": "Hello", "send_at": "2999-01-01T00:00:00Z"}`); rec.Code != http.StatusAccepted {
+		t.Fatalf("got status %d for scheduled mail: %s", rec.Code, rec.Body)
+	}
+}
@@ -1,8 +1,6 @@
 package main
 
 import (
-	"bytes"
-	"html/template"
 	"time"
 
 	"github.com/vanng822/go-premailer/premailer"
@@ -18,19 +16,46 @@ type Mail struct {
 	Encryption  string
 	FromAddress string
 	FromName    string
+	Templates   *TemplateRegistry
+	Transport   Transport
+	DKIM        *DKIMSigner
 }
 
 type Message struct {
 	From        string
 	FromName    string
-	To          string
+	To          AddressList
+	Cc          AddressList
+	Bcc         AddressList
+	ReplyTo     string
+	Headers     map[string]string
 	Subject     string
-	Attachments []string
+	Template    string
+	Locale      string
+	Attachments []Attachment
 	Data        any
 	DataMap     map[string]any
 }
 
-func (m *Mail) SendSMTPMessage(msg Message) error {
+// SendMessage renders msg and hands it to the configured transport.
+func (m *Mail) SendMessage(msg Message) error {
+	env, err := m.compose(msg)
+	if err != nil {
+		return err
+	}
+	return m.Transport.Send(env)
+}
+
+// sender returns the address msg goes out from.
+func (m *Mail) sender(msg Message) string {
+	if msg.From != "" {
+		return msg.From
+	}
+	return m.FromAddress
+}
+
+// compose renders the templates and builds the MIME message.
+func (m *Mail) compose(msg Message) (Envelope, error) {
 	if msg.From == "" {
 		msg.From = m.FromAddress
 	}
@@ -38,20 +63,68 @@ func (m *Mail) SendSMTPMessage(msg Message) error {
 	if msg.FromName == "" {
 		msg.FromName = m.FromName
 	}
-	data := map[string]any{
-		"message": msg.Data,
-	}
-	msg.DataMap = data
+	msg.DataMap = m.templateData(msg)
 
 	formattedMessage, err := m.buildHTMLMessage(msg)
 	if err != nil {
-		return err
+		return Envelope{}, err
 	}
 	plainMessage, err := m.buildPlainTextMessage(msg)
 	if err != nil {
-		return err
+		return Envelope{}, err
+	}
+
+	email := mail.NewMSG()
+	email.SetFrom(msg.From).
+		AddTo(msg.To...).
+		SetSubject(msg.Subject)
+	if len(msg.Cc) > 0 {
+		email.AddCc(msg.Cc...)
+	}
+	if len(msg.Bcc) > 0 {
+		email.AddBcc(msg.Bcc...)
+	}
+	if msg.ReplyTo != "" {
+		email.SetReplyTo(msg.ReplyTo)
+	}
+	for name, value := range msg.Headers {
+		email.AddHeader(name, value)
+	}
+	email.SetBody(mail.TextPlain, plainMessage)
+	email.AddAlternative(mail.TextHTML, formattedMessage)
+	for _, a := range msg.Attachments {
+		email.Attach(&mail.File{
+			Name:     a.Name,
+			MimeType: a.ContentType,
+			Data:     a.Data,
+			Inline:   a.Inline,
+		})
+	}
+	if email.Error != nil {
+		return Envelope{}, email.Error
+	}
+
+	raw := []byte(email.GetMessage())
+	if m.DKIM != nil {
+		raw, err = m.DKIM.Sign(raw)
+		if err != nil {
+			return Envelope{}, err
+		}
 	}
 
+	env := Envelope{
+		From:       email.GetFrom(),
+		Recipients: email.GetRecipients(),
+		Message:    msg,
+		HTML:       formattedMessage,
+		Plain:      plainMessage,
+		Raw:        raw,
+	}
+	return env, nil
+}
+
+// SMTPServer returns the connection settings for the configured mail server.
+func (m *Mail) SMTPServer() *mail.SMTPServer {
 	server := mail.NewSMTPClient()
 	server.Host = m.Host
 	server.Port = m.Port
@@ -61,41 +134,27 @@ func (m *Mail) SendSMTPMessage(msg Message) error {
 	server.KeepAlive = false
 	server.ConnectTimeout = 10 * time.Second
 	server.SendTimeout = 10 * time.Second
+	return server
+}
 
-	smtpClient, err := server.Connect()
-	if err != nil {
-		return err
+// templateData merges the free-form message body into the caller supplied variables,
+// so templates can always refer to {{.message}}.
+func (m *Mail) templateData(msg Message) map[string]any {
+	data := make(map[string]any, len(msg.DataMap)+1)
+	for k, v := range msg.DataMap {
+		data[k] = v
 	}
-	email := mail.NewMSG()
-	email.SetFrom(msg.From).
-		AddTo(msg.To).
-		SetSubject(msg.Subject)
-	email.SetBody(mail.TextPlain, plainMessage)
-	email.AddAlternative(mail.TextHTML, formattedMessage)
-	if len(msg.Attachments) > 0 {
-		for _, x := range msg.Attachments {
-			email.AddAttachment(x)
-		}
+	if _, ok := data["message"]; !ok {
+		data["message"] = msg.Data
 	}
-	err = email.Send(smtpClient)
-	if err != nil {
-		return err
-	}
-	return nil
-
+	return data
 }
-func (m *Mail) buildHTMLMessage(msg Message) (string, error) {
-	templateToRender := "./templates/mail.html.gohtml"
 
-	t, err := template.New("email-html").ParseFiles(templateToRender)
+func (m *Mail) buildHTMLMessage(msg Message) (string, error) {
+	formattedMessage, err := m.Templates.RenderHTML(msg.Template, msg.Locale, msg.DataMap)
 	if err != nil {
 		return "", err
 	}
-	var tpl bytes.Buffer
-	if err = t.ExecuteTemplate(&tpl, "body", msg.DataMap); err != nil {
-		return "", err
-	}
-	formattedMessage := tpl.String()
 	formattedMessage, err = m.inlineCSS(formattedMessage)
 	if err != nil {
 		return "", err
@@ -103,19 +162,23 @@ func (m *Mail) buildHTMLMessage(msg Message) (string, error) {
 	return formattedMessage, nil
 }
 func (m *Mail) buildPlainTextMessage(msg Message) (string, error) {
-	templateToRender := "./templates/mail.plain.gohtml"
+	return m.Templates.RenderPlain(msg.Template, msg.Locale, msg.DataMap)
+}
+
+// Preview renders both versions of a message exactly as SendMessage would,
+// without contacting the mail server.
+func (m *Mail) Preview(msg Message) (html string, plain string, err error) {
+	msg.DataMap = m.templateData(msg)
 
-	t, err := template.New("email-plain").ParseFiles(templateToRender)
+	html, err = m.buildHTMLMessage(msg)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
-	var tpl bytes.Buffer
-	if err = t.ExecuteTemplate(&tpl, "body", msg.DataMap); err != nil {
-		return "", err
+	plain, err = m.buildPlainTextMessage(msg)
+	if err != nil {
+		return "", "", err
 	}
-	plainMessage := tpl.String()
-
-	return plainMessage, nil
+	return html, plain, nil
 }
 
 func (m *Mail) inlineCSS(s string) (string, error) {
@@ -1,37 +1,129 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"time"
+	"toolbox/jsonutil"
+	"toolbox/tracing"
 )
 
 type Config struct {
 	Mailer Mail
+	Queue  *MailQueue
+	Limits AttachmentLimits
+
+	// Suppressions holds addresses that bounced or complained.
+	Suppressions *SuppressionList
+	// BounceSecret authenticates the providers posting to /bounces and the clients of
+	// the suppression list, neither of which is served without it.
+	BounceSecret string
+
+	// MaxRecipients caps the number of to, cc and bcc addresses of one message.
+	MaxRecipients int
+
+	// RateLimiter throttles mail per sender, recipient and recipient domain.
+	RateLimiter *RateLimiter
+
+	// Events is set when mail requests are also taken from RabbitMQ.
+	Events *MailEvents
+
+	// JSON reads and writes the request and response bodies.
+	JSON jsonutil.Tools
 }
 
 const webPort = "80"
 
 func main() {
 
+	// trace requests across the services
+	shutdownTracing, err := tracing.Init("mail-service")
+	if err != nil {
+		log.Panic(err)
+	}
+	defer shutdownTracing(context.Background())
+
+	mailer, err := createMail()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// parse all mail templates once, so a broken template stops the service at startup
+	templates, err := NewTemplateRegistry(templatesDir)
+	if err != nil {
+		log.Panic(err)
+	}
+	if locale := os.Getenv("MAIL_DEFAULT_LOCALE"); locale != "" {
+		templates.DefaultLocale = normalizeLocale(locale)
+	}
+	mailer.Templates = templates
+
 	app := Config{
-		Mailer: createMail(),
+		Mailer:        mailer,
+		Limits:        createAttachmentLimits(),
+		MaxRecipients: envInt("MAIL_MAX_RECIPIENTS", 50),
+	}
+
+	// Messages may carry base64 encoded attachments, so allow for those.
+	if app.Limits.MaxTotalSize > 0 {
+		app.JSON.MaxBytes = app.Limits.MaxRequestSize()
+	}
+
+	app.RateLimiter, err = createRateLimiter()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	suppressionFile := os.Getenv("MAIL_SUPPRESSION_FILE")
+	if suppressionFile == "" {
+		suppressionFile = "./suppressions.json"
 	}
+	app.Suppressions, err = NewSuppressionList(suppressionFile)
+	if err != nil {
+		log.Panic(err)
+	}
+	app.BounceSecret = os.Getenv("BOUNCE_WEBHOOK_SECRET")
+	if port := os.Getenv("BOUNCE_SMTP_PORT"); port != "" {
+		go app.bounceSMTPListen(port)
+	}
+
+	// deliver mail in the background, so an SMTP hiccup never loses a message
+	app.Queue, err = createQueue(&app.Mailer, app.Suppressions, envInt("MAIL_POOL_SIZE", 4))
+	if err != nil {
+		log.Panic(err)
+	}
+	// scheduled mail is charged when it goes out, not when it is accepted
+	app.Queue.RateLimiter = app.RateLimiter
+	// with AMQP_URL set, mail requests can also arrive via RabbitMQ and results are
+	// published there
+	if url := os.Getenv("AMQP_URL"); url != "" {
+		app.Events = &MailEvents{URL: url}
+		app.Queue.OnResult = app.Events.Publish
+	}
+	// the queue has to run before anything can add to it
+	app.Queue.Start()
+	if app.Events != nil {
+		go app.listenForMail()
+	}
+
 	log.Println("starting mail service on port:", webPort)
 
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%s", webPort),
 		Handler: app.routes(),
 	}
-	err := srv.ListenAndServe()
+	err = srv.ListenAndServe()
 	if err != nil {
 		log.Panic(err)
 	}
 }
 
-func createMail() Mail {
+// createMail reads the mail settings from the environment and sets up the transports.
+func createMail() (Mail, error) {
 	port, _ := strconv.Atoi(os.Getenv("MAIL_PORT"))
 	m := Mail{
 		Domain:      os.Getenv("MAIL_DOMAIN"),
@@ -43,5 +135,47 @@ func createMail() Mail {
 		FromName:    os.Getenv("FROM_NAME"),
 		FromAddress: os.Getenv("FROM_ADDRESS"),
 	}
-	return m
+
+	transport, err := createTransport(&m, envInt("MAIL_POOL_SIZE", 4))
+	if err != nil {
+		return Mail{}, err
+	}
+	m.Transport = transport
+
+	m.DKIM, err = createDKIMSigner(m.Domain)
+	if err != nil {
+		return Mail{}, err
+	}
+	return m, nil
+}
+
+func createQueue(m *Mail, suppressions *SuppressionList, workers int) (*MailQueue, error) {
+	dir := os.Getenv("MAIL_QUEUE_DIR")
+	if dir == "" {
+		dir = "./queue"
+	}
+	store, err := NewQueueStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	q := &MailQueue{
+		Mailer:       m,
+		Suppressions: suppressions,
+		Store:        store,
+		Workers:      envInt("MAIL_WORKERS", workers),
+		MaxAttempts:  envInt("MAIL_MAX_ATTEMPTS", 5),
+		BaseDelay:    time.Duration(envInt("MAIL_RETRY_DELAY_SECONDS", 2)) * time.Second,
+		MaxDelay:     10 * time.Minute,
+		Retention:    time.Duration(envInt("MAIL_RETENTION_HOURS", 7*24)) * time.Hour,
+	}
+	return q, nil
+}
+
+// envInt reads an integer from the environment, falling back to def when unset or invalid.
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || v <= 0 {
+		return def
+	}
+	return v
 }
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"container/heap"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	StatusScheduled = "scheduled"
+	StatusCancelled = "cancelled"
+	StatusQueued    = "queued"
+	StatusSending   = "sending"
+	StatusSent      = "sent"
+	StatusFailed    = "failed"
+)
+
+var (
+	// ErrMessageNotFound is returned when the queue has no message with the requested ID.
+	ErrMessageNotFound = errors.New("message not found")
+
+	// ErrDuplicateMessage is returned when a message is added with an ID already in use.
+	ErrDuplicateMessage = errors.New("a message with this ID already exists")
+)
+
+// QueuedMessage is one outbound message together with its delivery state.
+type QueuedMessage struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"last_error,omitempty"`
+	NextAttempt time.Time  `json:"next_attempt"`
+	SendAt      *time.Time `json:"send_at,omitempty"`
+	Timezone    string     `json:"timezone,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	Message     Message    `json:"message"`
+}
+
+// QueueStore persists queued messages as one JSON file per message, so nothing is
+// lost when the service restarts. All records are also kept in memory, and indexed by
+// time per status, so finding due or expired messages does not scan them all.
+type QueueStore struct {
+	dir     string
+	mu      sync.Mutex
+	records map[string]*QueuedMessage
+	indexes map[string]*timeIndex
+}
+
+// indexedStatuses are the statuses whose records are looked up by time: waiting
+// messages when they are due, finished ones when they expire.
+var indexedStatuses = []string{StatusScheduled, StatusQueued, StatusSent, StatusFailed, StatusCancelled}
+
+// finishedStatuses are the statuses a message never leaves.
+var finishedStatuses = []string{StatusSent, StatusFailed, StatusCancelled}
+
+// indexTime is the time a record is indexed under: when it is due while it waits, and
+// when it was last changed once it has finished.
+func indexTime(qm *QueuedMessage) time.Time {
+	if qm.Status == StatusScheduled || qm.Status == StatusQueued {
+		return qm.NextAttempt
+	}
+	return qm.UpdatedAt
+}
+
+// timeIndex is a min-heap of records by time. Entries are not removed when a record
+// changes; stale ones are skipped once they reach the top.
+type timeIndex []indexEntry
+
+type indexEntry struct {
+	at time.Time
+	id string
+}
+
+func (x timeIndex) Len() int           { return len(x) }
+func (x timeIndex) Less(i, j int) bool { return x[i].at.Before(x[j].at) }
+func (x timeIndex) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+func (x *timeIndex) Push(e any)        { *x = append(*x, e.(indexEntry)) }
+func (x *timeIndex) Pop() any {
+	old := *x
+	e := old[len(old)-1]
+	*x = old[:len(old)-1]
+	return e
+}
+
+// NewQueueStore opens (or creates) the queue directory and loads every stored message.
+func NewQueueStore(dir string) (*QueueStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	store := &QueueStore{
+		dir:     dir,
+		records: make(map[string]*QueuedMessage),
+		indexes: make(map[string]*timeIndex, len(indexedStatuses)),
+	}
+	for _, status := range indexedStatuses {
+		store.indexes[status] = &timeIndex{}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var qm QueuedMessage
+		if err := json.Unmarshal(b, &qm); err != nil {
+			log.Printf("skipping corrupt queue file %s: %v", file, err)
+			continue
+		}
+		// a message that was being sent when we stopped has to be tried again
+		if qm.Status == StatusSending {
+			qm.Status = StatusQueued
+		}
+		store.records[qm.ID] = &qm
+		store.index(&qm)
+	}
+	return store, nil
+}
+
+// index adds qm to the index of its status, if it has one.
+func (s *QueueStore) index(qm *QueuedMessage) {
+	if idx := s.indexes[qm.Status]; idx != nil {
+		heap.Push(idx, indexEntry{at: indexTime(qm), id: qm.ID})
+	}
+}
+
+// next removes the record of status indexed under the earliest time not after t from
+// the index and returns it.
+func (s *QueueStore) next(status string, t time.Time) (*QueuedMessage, bool) {
+	idx := s.indexes[status]
+	for idx.Len() > 0 && !(*idx)[0].at.After(t) {
+		e := heap.Pop(idx).(indexEntry)
+		qm, ok := s.records[e.id]
+		if ok && qm.Status == status && indexTime(qm).Equal(e.at) {
+			return qm, true
+		}
+	}
+	return nil, false
+}
+
+// Save writes the record to disk and updates the in-memory copy.
+func (s *QueueStore) Save(qm QueuedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save(&qm)
+}
+
+func (s *QueueStore) save(qm *QueuedMessage) error {
+	qm.UpdatedAt = time.Now()
+	b, err := json.Marshal(qm)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first, so a crash never leaves a half written record
+	path := filepath.Join(s.dir, qm.ID+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	s.records[qm.ID] = qm
+	s.index(qm)
+	return nil
+}
+
+// Create saves a new record, failing with ErrDuplicateMessage if the ID is taken.
+func (s *QueueStore) Create(qm QueuedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.records[qm.ID]; ok {
+		return ErrDuplicateMessage
+	}
+	return s.save(&qm)
+}
+
+// Get returns a copy of the record with the given ID.
+func (s *QueueStore) Get(id string) (QueuedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	qm, ok := s.records[id]
+	if !ok {
+		return QueuedMessage{}, ErrMessageNotFound
+	}
+	return *qm, nil
+}
+
+// List returns copies of all records with the given status.
+func (s *QueueStore) List(status string) []QueuedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []QueuedMessage
+	for _, qm := range s.records {
+		if qm.Status == status {
+			list = append(list, *qm)
+		}
+	}
+	return list
+}
+
+// Update applies fn to the record with the given ID and saves it, unless fn fails.
+func (s *QueueStore) Update(id string, fn func(qm *QueuedMessage) error) (QueuedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	qm, ok := s.records[id]
+	if !ok {
+		return QueuedMessage{}, ErrMessageNotFound
+	}
+	updated := *qm
+	if err := fn(&updated); err != nil {
+		return QueuedMessage{}, err
+	}
+	if err := s.save(&updated); err != nil {
+		return QueuedMessage{}, err
+	}
+	return updated, nil
+}
+
+// ClaimDue marks up to limit queued messages whose next attempt is due as sending
+// and returns them.
+func (s *QueueStore) ClaimDue(now time.Time, limit int) []QueuedMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []QueuedMessage
+	for len(due) < limit {
+		qm, ok := s.next(StatusQueued, now)
+		if !ok {
+			break
+		}
+		claimed := *qm
+		claimed.Status = StatusSending
+		if err := s.save(&claimed); err != nil {
+			// leave it to the next round
+			log.Println("error claiming message", qm.ID, err)
+			s.index(qm)
+			break
+		}
+		due = append(due, claimed)
+	}
+	return due
+}
+
+// ReleaseScheduled queues the scheduled messages whose send time has come and returns
+// how many there were.
+func (s *QueueStore) ReleaseScheduled(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	released := 0
+	for {
+		qm, ok := s.next(StatusScheduled, now)
+		if !ok {
+			return released
+		}
+		queued := *qm
+		queued.Status = StatusQueued
+		if err := s.save(&queued); err != nil {
+			log.Println("error releasing scheduled message", qm.ID, err)
+			s.index(qm)
+			return released
+		}
+		released++
+	}
+}
+
+// Prune forgets the messages that were sent, failed or cancelled before t, on disk
+// and in memory, and returns how many there were.
+func (s *QueueStore) Prune(t time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pruned := 0
+	for _, status := range finishedStatuses {
+		for {
+			qm, ok := s.next(status, t)
+			if !ok {
+				break
+			}
+			err := os.Remove(filepath.Join(s.dir, qm.ID+".json"))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Println("error pruning message", qm.ID, err)
+				s.index(qm)
+				break
+			}
+			delete(s.records, qm.ID)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// MailQueue delivers messages in the background with a fixed number of workers,
+// retrying failed sends with exponential backoff until MaxAttempts is reached, after
+// which the message is left in the failed (dead-letter) state.
+type MailQueue struct {
+	Mailer       *Mail
+	Suppressions *SuppressionList
+	Store        *QueueStore
+	Workers      int
+	MaxAttempts  int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	// Retention is how long sent, failed and cancelled messages can still be looked
+	// up. They are kept for good when it is zero.
+	Retention time.Duration
+	// RateLimiter, when set, holds scheduled messages back until the limits of their
+	// sender and recipients let them go out. Waiting for it does not count as an
+	// attempt. Other messages were charged when they were accepted.
+	RateLimiter *RateLimiter
+
+	// OnResult, when set, is called once a message has been sent or has failed for good.
+	OnResult func(qm QueuedMessage)
+
+	jobs chan QueuedMessage
+	wake chan struct{}
+}
+
+// Enqueue stores msg and schedules it for immediate delivery. id identifies the message
+// and is generated when empty.
+func (q *MailQueue) Enqueue(id string, msg Message) (QueuedMessage, error) {
+	id, err := messageID(id)
+	if err != nil {
+		return QueuedMessage{}, err
+	}
+	now := time.Now()
+	qm := QueuedMessage{
+		ID:          id,
+		Status:      StatusQueued,
+		NextAttempt: now,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		Message:     msg,
+	}
+	if err := q.Store.Create(qm); err != nil {
+		return QueuedMessage{}, err
+	}
+
+	// nudge the dispatcher, it will otherwise pick the message up on its next tick
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return qm, nil
+}
+
+// Reject records a message that was refused before it could be queued as failed, so
+// its ID can still be looked up.
+func (q *MailQueue) Reject(id string, msg Message, reason error) (QueuedMessage, error) {
+	id, err := messageID(id)
+	if err != nil {
+		return QueuedMessage{}, err
+	}
+	now := time.Now()
+	qm := QueuedMessage{
+		ID:        id,
+		Status:    StatusFailed,
+		LastError: reason.Error(),
+		CreatedAt: now,
+		UpdatedAt: now,
+		Message:   msg,
+	}
+	if err := q.Store.Create(qm); err != nil {
+		return QueuedMessage{}, err
+	}
+	q.finished(qm)
+	return qm, nil
+}
+
+// Status returns the current delivery state of a message.
+func (q *MailQueue) Status(id string) (QueuedMessage, error) {
+	return q.Store.Get(id)
+}
+
+// Start launches the dispatcher, the scheduler and the worker goroutines.
+func (q *MailQueue) Start() {
+	q.jobs = make(chan QueuedMessage, q.Workers)
+	q.wake = make(chan struct{}, 1)
+
+	for i := 0; i < q.Workers; i++ {
+		go q.worker()
+	}
+	go q.dispatch()
+	go q.schedule()
+	if q.Retention > 0 {
+		go q.prune()
+	}
+}
+
+// prune forgets finished messages once they are older than Retention.
+func (q *MailQueue) prune() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if n := q.Store.Prune(time.Now().Add(-q.Retention)); n > 0 {
+			log.Printf("pruned %d finished messages", n)
+		}
+	}
+}
+
+func (q *MailQueue) dispatch() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		due := q.Store.ClaimDue(time.Now(), q.Workers)
+		for _, qm := range due {
+			q.jobs <- qm
+		}
+		// a full batch means there is probably more waiting, keep going
+		if len(due) == q.Workers {
+			continue
+		}
+		select {
+		case <-ticker.C:
+		case <-q.wake:
+		}
+	}
+}
+
+func (q *MailQueue) worker() {
+	for qm := range q.jobs {
+		q.deliver(qm)
+	}
+}
+
+func (q *MailQueue) deliver(qm QueuedMessage) {
+	// addresses may have bounced since the message was queued
+	if removed := q.Suppressions.Filter(&qm.Message); len(removed) > 0 && recipientCount(qm.Message) == 0 {
+		qm.Status = StatusFailed
+		qm.LastError = "all recipients are on the suppression list"
+		if err := q.Store.Save(qm); err != nil {
+			log.Println("error saving message state", qm.ID, err)
+		}
+		q.finished(qm)
+		return
+	}
+
+	if q.RateLimiter != nil && qm.SendAt != nil && qm.Attempts == 0 {
+		var limited *RateLimitError
+		if err := q.RateLimiter.Allow(q.Mailer.sender(qm.Message), qm.Message); errors.As(err, &limited) {
+			qm.Status = StatusQueued
+			qm.LastError = err.Error()
+			qm.NextAttempt = time.Now().Add(limited.RetryAfter)
+			if err := q.Store.Save(qm); err != nil {
+				log.Println("error saving message state", qm.ID, err)
+			}
+			return
+		}
+	}
+
+	qm.Attempts++
+	err := q.Mailer.SendMessage(qm.Message)
+	switch {
+	case err == nil:
+		qm.Status = StatusSent
+		qm.LastError = ""
+	case qm.Attempts >= q.MaxAttempts:
+		log.Printf("giving up on message %s after %d attempts: %v", qm.ID, qm.Attempts, err)
+		qm.Status = StatusFailed
+		qm.LastError = err.Error()
+	default:
+		log.Printf("attempt %d for message %s failed: %v", qm.Attempts, qm.ID, err)
+		qm.Status = StatusQueued
+		qm.LastError = err.Error()
+		qm.NextAttempt = time.Now().Add(q.backoff(qm.Attempts))
+	}
+
+	if err := q.Store.Save(qm); err != nil {
+		log.Println("error saving message state", qm.ID, err)
+	}
+	if qm.Status != StatusQueued {
+		q.finished(qm)
+	}
+}
+
+func (q *MailQueue) finished(qm QueuedMessage) {
+	if q.OnResult != nil {
+		q.OnResult(qm)
+	}
+}
+
+// backoff returns the delay before the next attempt: BaseDelay doubled for every
+// failed attempt, capped at MaxDelay.
+func (q *MailQueue) backoff(attempts int) time.Duration {
+	delay := q.BaseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= q.MaxDelay {
+			return q.MaxDelay
+		}
+	}
+	return delay
+}
+
+// messageID checks an ID supplied by a client, or generates one when it is empty. IDs
+// end up in file names, so only letters, digits, '-' and '_' are accepted.
+func messageID(id string) (string, error) {
+	if id == "" {
+		return newMessageID()
+	}
+	if len(id) < 8 || len(id) > 64 {
+		return "", errors.New("message ID must be 8 to 64 characters long")
+	}
+	for _, r := range id {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_') {
+			return "", errors.New("message ID may only contain letters, digits, '-' and '_'")
+		}
+	}
+	return id, nil
+}
+
+func newMessageID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) (*QueueStore, string) {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := NewQueueStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, dir
+}
+
+func createMessage(t *testing.T, store *QueueStore, id, status string, at time.Time) {
+	t.Helper()
+	qm := QueuedMessage{ID: id, Status: status, NextAttempt: at, CreatedAt: at}
+	if err := store.Create(qm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClaimDueInOrder(t *testing.T) {
+	store, _ := newTestStore(t)
+	now := time.Now()
+	createMessage(t, store, "later-message", StatusQueued, now.Add(-time.Second))
+	createMessage(t, store, "first-message", StatusQueued, now.Add(-time.Minute))
+	createMessage(t, store, "future-message", StatusQueued, now.Add(time.Hour))
+	createMessage(t, store, "planned-message", StatusScheduled, now.Add(-time.Hour))
+
+	due := store.ClaimDue(now, 1)
+	if len(due) != 1 || due[0].ID != "first-message" || due[0].Status != StatusSending {
+		t.Fatalf("got %+v, want first-message", due)
+	}
+	due = store.ClaimDue(now, 10)
+	if len(due) != 1 || due[0].ID != "later-message" {
+		t.Fatalf("got %+v, want later-message", due)
+	}
+	if due := store.ClaimDue(now, 10); len(due) != 0 {
+		t.Fatalf("claimed %+v again", due)
+	}
+
+	// a retry is due again after its backoff
+	retry := QueuedMessage{ID: "first-message", Status: StatusQueued, Attempts: 1, NextAttempt: now.Add(time.Minute)}
+	if err := store.Save(retry); err != nil {
+		t.Fatal(err)
+	}
+	if due := store.ClaimDue(now, 10); len(due) != 0 {
+		t.Fatalf("claimed %+v before its retry was due", due)
+	}
+	if due := store.ClaimDue(now.Add(time.Minute), 10); len(due) != 1 || due[0].ID != "first-message" {
+		t.Fatalf("got %+v, want the retry of first-message", due)
+	}
+}
+
+func TestReleaseScheduled(t *testing.T) {
+	store, _ := newTestStore(t)
+	now := time.Now()
+	createMessage(t, store, "due-message", StatusScheduled, now.Add(-time.Second))
+	createMessage(t, store, "cancelled-message", StatusScheduled, now.Add(-time.Second))
+	createMessage(t, store, "future-message", StatusScheduled, now.Add(time.Hour))
+	if _, err := store.Update("cancelled-message", func(qm *QueuedMessage) error {
+		qm.Status = StatusCancelled
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := store.ReleaseScheduled(now); n != 1 {
+		t.Fatalf("released %d messages, want 1", n)
+	}
+	if qm, _ := store.Get("due-message"); qm.Status != StatusQueued {
+		t.Errorf("due-message is %s", qm.Status)
+	}
+	if qm, _ := store.Get("cancelled-message"); qm.Status != StatusCancelled {
+		t.Errorf("cancelled-message is %s", qm.Status)
+	}
+	if due := store.ClaimDue(now, 10); len(due) != 1 || due[0].ID != "due-message" {
+		t.Fatalf("got %+v, want due-message", due)
+	}
+}
+
+func TestPruneFinishedMessages(t *testing.T) {
+	store, dir := newTestStore(t)
+	now := time.Now()
+	for _, status := range []string{StatusSent, StatusFailed, StatusCancelled, StatusQueued, StatusScheduled} {
+		createMessage(t, store, status+"-message", status, now)
+	}
+
+	if n := store.Prune(now.Add(-time.Hour)); n != 0 {
+		t.Fatalf("pruned %d messages that had not expired", n)
+	}
+	if n := store.Prune(now.Add(time.Second)); n != 3 {
+		t.Fatalf("pruned %d messages, want 3", n)
+	}
+	for _, status := range []string{StatusSent, StatusFailed, StatusCancelled} {
+		if _, err := store.Get(status + "-message"); err != ErrMessageNotFound {
+			t.Errorf("the %s message is still there: %v", status, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, status+"-message.json")); !os.IsNotExist(err) {
+			t.Errorf("the file of the %s message is still there: %v", status, err)
+		}
+	}
+	for _, status := range []string{StatusQueued, StatusScheduled} {
+		if _, err := store.Get(status + "-message"); err != nil {
+			t.Errorf("the %s message was pruned", status)
+		}
+	}
+}
+
+func TestQueueStoreReloadsIndexes(t *testing.T) {
+	store, dir := newTestStore(t)
+	now := time.Now()
+	createMessage(t, store, "queued-message", StatusQueued, now.Add(-time.Second))
+	createMessage(t, store, "sending-message", StatusSending, now.Add(-time.Second))
+	createMessage(t, store, "sent-message", StatusSent, now)
+
+	store, err := NewQueueStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the message being sent when we stopped is tried again
+	if due := store.ClaimDue(now, 10); len(due) != 2 {
+		t.Fatalf("claimed %+v, want the queued and the sending message", due)
+	}
+	if n := store.Prune(now.Add(time.Second)); n != 1 {
+		t.Fatalf("pruned %d messages, want 1", n)
+	}
+}
+
+// TestDeliverWaitsForRateLimit checks that scheduled mail is charged when it is sent.
+func TestDeliverWaitsForRateLimit(t *testing.T) {
+	store, _ := newTestStore(t)
+	templates, err := NewTemplateRegistry("../../templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, err := NewFileTransport(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	suppressions, err := NewSuppressionList(filepath.Join(t.TempDir(), "suppressions.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := &MailQueue{
+		Mailer:       &Mail{FromAddress: "sender@example.com", Templates: templates, Transport: transport},
+		Suppressions: suppressions,
+		Store:        store,
+		MaxAttempts:  3,
+		RateLimiter: &RateLimiter{
+			Recipient: NewKeyedLimiter(Rate{Count: 1, Period: time.Minute}),
+			throttled: make(map[string]int64),
+		},
+	}
+
+	now := time.Now()
+	msg := Message{To: AddressList{"rcpt@example.org"}, Subject: "Hello", Template: "mail", Data: "Hello"}
+	for _, id := range []string{"first-message", "second-message"} {
+		qm := QueuedMessage{ID: id, Status: StatusSending, NextAttempt: now, SendAt: &now, CreatedAt: now, Message: msg}
+		if err := store.Create(qm); err != nil {
+			t.Fatal(err)
+		}
+		q.deliver(qm)
+	}
+
+	if qm, _ := store.Get("first-message"); qm.Status != StatusSent {
+		t.Errorf("first-message is %s: %s", qm.Status, qm.LastError)
+	}
+	qm, _ := store.Get("second-message")
+	if qm.Status != StatusQueued || qm.Attempts != 0 || !qm.NextAttempt.After(now.Add(30*time.Second)) {
+		t.Errorf("second-message is %s after %d attempts, next at %s", qm.Status, qm.Attempts, qm.NextAttempt.Sub(now))
+	}
+	if m := q.RateLimiter.Metrics(); m.Allowed != 1 || m.Throttled[LimitRecipient] != 1 {
+		t.Errorf("got metrics %+v", m)
+	}
+}
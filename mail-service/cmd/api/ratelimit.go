@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LimitSender    = "sender"
+	LimitRecipient = "recipient"
+	LimitDomain    = "domain"
+)
+
+// RateLimitError is returned when a message would exceed one of the send limits.
+type RateLimitError struct {
+	Kind       string
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("too many messages for %s %s, retry in %s", e.Kind, e.Key, e.RetryAfter.Round(time.Second))
+}
+
+// Rate is a number of messages allowed per period. The full amount may be used at
+// once, after which the bucket refills evenly over the period.
+type Rate struct {
+	Count  int
+	Period time.Duration
+}
+
+// parseRate reads limits like "10/m", "500/h" or "1000/d". "off" disables the limit.
+func parseRate(s string) (Rate, error) {
+	if s == "off" {
+		return Rate{}, nil
+	}
+	count, unit, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(count)
+	if !ok || err != nil || n <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q, use e.g. 10/m", s)
+	}
+	periods := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}
+	period, ok := periods[unit]
+	if !ok {
+		return Rate{}, fmt.Errorf("invalid rate %q, the unit must be s, m, h or d", s)
+	}
+	return Rate{Count: n, Period: period}, nil
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// KeyedLimiter keeps one token bucket per key, e.g. per recipient address.
+type KeyedLimiter struct {
+	rate    Rate
+	buckets map[string]*tokenBucket
+}
+
+func NewKeyedLimiter(rate Rate) *KeyedLimiter {
+	return &KeyedLimiter{rate: rate, buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *KeyedLimiter) enabled() bool {
+	return l != nil && l.rate.Count > 0
+}
+
+// refill returns the bucket for key with the tokens earned since it was last used.
+func (l *KeyedLimiter) refill(key string, now time.Time) *tokenBucket {
+	capacity := float64(l.rate.Count)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+	perToken := l.rate.Period / time.Duration(l.rate.Count)
+	b.tokens = math.Min(capacity, b.tokens+float64(now.Sub(b.last))/float64(perToken))
+	b.last = now
+	return b
+}
+
+// wait returns how long until n tokens are available for key, zero if they are now.
+func (l *KeyedLimiter) wait(key string, n int, now time.Time) time.Duration {
+	b := l.refill(key, now)
+	if b.tokens >= float64(n) {
+		return 0
+	}
+	if n > l.rate.Count {
+		// can never be satisfied in one go, so don't let the client retry soon
+		return l.rate.Period
+	}
+	perToken := l.rate.Period / time.Duration(l.rate.Count)
+	return time.Duration((float64(n) - b.tokens) * float64(perToken))
+}
+
+func (l *KeyedLimiter) take(key string, n int) {
+	l.buckets[key].tokens -= float64(n)
+}
+
+// prune drops buckets that have refilled completely, as they behave like new ones.
+func (l *KeyedLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= l.rate.Period {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RateLimiter throttles mail per sender, per recipient address and per recipient
+// domain. A message only goes out when all of its limits allow it, so a message that
+// is held back uses up no tokens.
+type RateLimiter struct {
+	Sender    *KeyedLimiter
+	Recipient *KeyedLimiter
+	Domain    *KeyedLimiter
+
+	mu        sync.Mutex
+	allowed   int64
+	throttled map[string]int64
+	lastPrune time.Time
+}
+
+// RateLimitMetrics is a snapshot of the limiter counters.
+type RateLimitMetrics struct {
+	Allowed     int64             `json:"allowed"`
+	Throttled   map[string]int64  `json:"throttled"`
+	TrackedKeys map[string]int    `json:"tracked_keys"`
+	Limits      map[string]string `json:"limits"`
+}
+
+// Allow checks msg against all limits and takes its tokens when it may be sent. The
+// sender is the address the mail goes out from.
+func (rl *RateLimiter) Allow(sender string, msg Message) error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rl.lastPrune) > time.Minute {
+		for _, l := range []*KeyedLimiter{rl.Sender, rl.Recipient, rl.Domain} {
+			if l.enabled() {
+				l.prune(now)
+			}
+		}
+		rl.lastPrune = now
+	}
+
+	type cost struct {
+		kind    string
+		limiter *KeyedLimiter
+		key     string
+		n       int
+	}
+	var costs []cost
+
+	recipients := messageRecipients(msg)
+	if rl.Sender.enabled() && sender != "" {
+		// every recipient counts, so one mail to 50 people costs as much as 50 mails
+		costs = append(costs, cost{LimitSender, rl.Sender, strings.ToLower(sender), len(recipients)})
+	}
+	domains := make(map[string]int)
+	for _, addr := range recipients {
+		if rl.Recipient.enabled() {
+			costs = append(costs, cost{LimitRecipient, rl.Recipient, addr, 1})
+		}
+		if _, domain, ok := strings.Cut(addr, "@"); ok {
+			domains[domain]++
+		}
+	}
+	if rl.Domain.enabled() {
+		for domain, n := range domains {
+			costs = append(costs, cost{LimitDomain, rl.Domain, domain, n})
+		}
+	}
+
+	var limited *RateLimitError
+	for _, c := range costs {
+		if wait := c.limiter.wait(c.key, c.n, now); wait > 0 && (limited == nil || wait > limited.RetryAfter) {
+			limited = &RateLimitError{Kind: c.kind, Key: c.key, RetryAfter: wait}
+		}
+	}
+	if limited != nil {
+		rl.throttled[limited.Kind]++
+		return limited
+	}
+
+	for _, c := range costs {
+		c.limiter.take(c.key, c.n)
+	}
+	rl.allowed++
+	return nil
+}
+
+// Metrics returns the number of allowed and throttled messages so far.
+func (rl *RateLimiter) Metrics() RateLimitMetrics {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	m := RateLimitMetrics{
+		Allowed:     rl.allowed,
+		Throttled:   make(map[string]int64),
+		TrackedKeys: make(map[string]int),
+		Limits:      make(map[string]string),
+	}
+	for kind, l := range map[string]*KeyedLimiter{LimitSender: rl.Sender, LimitRecipient: rl.Recipient, LimitDomain: rl.Domain} {
+		m.Throttled[kind] = rl.throttled[kind]
+		if !l.enabled() {
+			m.Limits[kind] = "off"
+			continue
+		}
+		m.TrackedKeys[kind] = len(l.buckets)
+		m.Limits[kind] = fmt.Sprintf("%d per %s", l.rate.Count, l.rate.Period)
+	}
+	return m
+}
+
+// messageRecipients returns the lower-cased addresses of all to, cc and bcc recipients.
+func messageRecipients(msg Message) []string {
+	var all []string
+	for _, list := range []AddressList{msg.To, msg.Cc, msg.Bcc} {
+		for _, a := range list {
+			if addr, err := mail.ParseAddress(a); err == nil {
+				all = append(all, strings.ToLower(addr.Address))
+			}
+		}
+	}
+	return all
+}
+
+// createRateLimiter reads the limits from MAIL_RATE_SENDER, MAIL_RATE_RECIPIENT and
+// MAIL_RATE_DOMAIN.
+func createRateLimiter() (*RateLimiter, error) {
+	rl := &RateLimiter{throttled: make(map[string]int64)}
+	for _, setting := range []struct {
+		env, def string
+		limiter  **KeyedLimiter
+	}{
+		{"MAIL_RATE_SENDER", "1000/h", &rl.Sender},
+		{"MAIL_RATE_RECIPIENT", "10/m", &rl.Recipient},
+		{"MAIL_RATE_DOMAIN", "600/m", &rl.Domain},
+	} {
+		value := os.Getenv(setting.env)
+		if value == "" {
+			value = setting.def
+		}
+		rate, err := parseRate(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", setting.env, err)
+		}
+		*setting.limiter = NewKeyedLimiter(rate)
+	}
+	return rl, nil
+}
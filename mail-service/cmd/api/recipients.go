@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// AddressList is a list of mail addresses. In JSON it may also be given as a single
+// string, which keeps requests written for the old single "to" field working.
+type AddressList []string
+
+func (l *AddressList) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		if single == "" {
+			*l = nil
+		} else {
+			*l = AddressList{single}
+		}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return errors.New("address list must be a string or an array of strings")
+	}
+	*l = list
+	return nil
+}
+
+// String returns the addresses separated by commas.
+func (l AddressList) String() string {
+	return strings.Join(l, ", ")
+}
+
+// reservedHeaders are managed by the mailer itself and cannot be set by callers.
+var reservedHeaders = map[string]bool{
+	"Bcc":                       true,
+	"Cc":                        true,
+	"Content-Transfer-Encoding": true,
+	"Content-Type":              true,
+	"Date":                      true,
+	"Dkim-Signature":            true,
+	"From":                      true,
+	"Mime-Version":              true,
+	"Reply-To":                  true,
+	"Return-Path":               true,
+	"Sender":                    true,
+	"Subject":                   true,
+	"To":                        true,
+}
+
+// checkRecipients validates and normalizes every address of the message and the
+// custom headers, and enforces the per-message recipient cap.
+func checkRecipients(msg *Message, maxRecipients int) error {
+	seen := make(map[string]bool)
+
+	var err error
+	if msg.To, err = normalizeAddresses("to", msg.To, seen); err != nil {
+		return err
+	}
+	if msg.Cc, err = normalizeAddresses("cc", msg.Cc, seen); err != nil {
+		return err
+	}
+	if msg.Bcc, err = normalizeAddresses("bcc", msg.Bcc, seen); err != nil {
+		return err
+	}
+
+	if len(msg.To) == 0 {
+		return errors.New("at least one recipient is required in to")
+	}
+	if len(seen) > maxRecipients {
+		return fmt.Errorf("too many recipients: %d, at most %d allowed", len(seen), maxRecipients)
+	}
+
+	if msg.ReplyTo != "" {
+		addr, err := mail.ParseAddress(msg.ReplyTo)
+		if err != nil {
+			return fmt.Errorf("reply_to: invalid address %q", msg.ReplyTo)
+		}
+		msg.ReplyTo = addr.String()
+	}
+
+	headers := make(map[string]string, len(msg.Headers))
+	for name, value := range msg.Headers {
+		if !isHeaderName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if reservedHeaders[name] {
+			return fmt.Errorf("header %s cannot be set", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("header %s must be a single line", name)
+		}
+		headers[name] = value
+	}
+	msg.Headers = headers
+
+	return nil
+}
+
+// recipientCount is the number of to, cc and bcc addresses of msg.
+func recipientCount(msg Message) int {
+	return len(msg.To) + len(msg.Cc) + len(msg.Bcc)
+}
+
+// normalizeAddresses parses each address and drops addresses already seen in this
+// message, so nobody receives the same mail twice.
+func normalizeAddresses(field string, addresses []string, seen map[string]bool) ([]string, error) {
+	var out []string
+	for _, a := range addresses {
+		addr, err := mail.ParseAddress(a)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid address %q", field, a)
+		}
+		key := strings.ToLower(addr.Address)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, addr.String())
+	}
+	return out, nil
+}
+
+// isHeaderName reports whether s is a valid header field name (RFC 5322, 3.6.8).
+func isHeaderName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < 33 || c > 126 || c == ':' {
+			return false
+		}
+	}
+	return true
+}
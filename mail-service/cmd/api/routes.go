@@ -2,30 +2,50 @@ package main
 
 import (
 	"net/http"
+	"toolbox/tracing"
+	"toolbox/web"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/go-chi/cors"
 )
 
 func (app *Config) routes() http.Handler {
 
 	mux := chi.NewRouter()
 
-	// Enable Cross-Origin Resource Sharing middleware to specify who is allowed to connect.
-	mux.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"https://*", "http://*"},                                  // Allow requests from any origin with HTTP or HTTPS.
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},                // Allow specified HTTP methods.
-		AllowedHeaders:   []string{"Accept", "Authorizaton", "Content-Type", "X-CSRG-Token"}, // Allow specific headers.
-		ExposedHeaders:   []string{"Link"},                                                   // Expose the 'Link' header in responses.
-		AllowCredentials: true,                                                               // Allow sending credentials (e.g., cookies) with requests.
-		MaxAge:           300,                                                                // Cache preflight (OPTIONS) request results for 300 seconds.
-	}))
+	// Trace every request, continuing the trace of the caller.
+	mux.Use(tracing.Handler)
+
+	// Enable Cross-Origin Resource Sharing middleware to specify who is allowed to connect,
+	// from the origins listed in CORS_ALLOWED_ORIGINS.
+	mux.Use(web.CORS(web.CORSOptions{}))
+
+	// Send the standard security headers (HSTS, CSP, nosniff) with every response.
+	mux.Use(web.SecurityHeaders(web.SecurityOptions{}))
 
 	// Add a middleware that responds to a '/ping' endpoint with a heartbeat message.
 	mux.Use(middleware.Heartbeat("/ping"))
 
 	mux.Post("/send", app.SendMail)
+	mux.Get("/messages/{id}", app.MessageStatus)
+	mux.Get("/scheduled", app.ListScheduled)
+	mux.Delete("/scheduled/{id}", app.CancelScheduled)
+	mux.Post("/preview", app.PreviewMail)
+	mux.Get("/templates", app.ListTemplates)
+	mux.Get("/metrics", app.RateLimitMetrics)
+
+	// Bounces and the suppression list need BOUNCE_WEBHOOK_SECRET, and are not served
+	// without it.
+	if app.BounceSecret != "" {
+		mux.Post("/bounces", app.ReceiveBounce)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requireSecret)
+			mux.Get("/suppressions", app.ListSuppressions)
+			mux.Post("/suppressions", app.AddSuppression)
+			mux.Get("/suppressions/{address}", app.GetSuppression)
+			mux.Delete("/suppressions/{address}", app.RemoveSuppression)
+		})
+	}
 
 	// Return the configured router as an HTTP handler.
 	return mux
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+	_ "time/tzdata" // the alpine image ships without zoneinfo
+)
+
+// ErrNotScheduled is returned when cancelling a message that is no longer waiting.
+var ErrNotScheduled = errors.New("message is not scheduled")
+
+// sendAtLayouts are accepted for send_at values without a UTC offset, which are read
+// in the request's timezone.
+var sendAtLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+// parseSendAt reads a send_at timestamp. RFC 3339 values carry their own offset;
+// anything else is local time in timezone (an IANA name such as Europe/Berlin, UTC
+// when empty).
+func parseSendAt(sendAt, timezone string) (time.Time, error) {
+	loc := time.UTC
+	if timezone != "" {
+		var err error
+		loc, err = time.LoadLocation(timezone)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unknown timezone: %s", timezone)
+		}
+	}
+
+	if t, err := time.Parse(time.RFC3339, sendAt); err == nil {
+		return t, nil
+	}
+	for _, layout := range sendAtLayouts {
+		if t, err := time.ParseInLocation(layout, sendAt, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid send_at %q, use RFC 3339 or YYYY-MM-DDTHH:MM[:SS]", sendAt)
+}
+
+// sendTime parses send_at like parseSendAt and rejects times in the past.
+func sendTime(sendAt, timezone string) (time.Time, error) {
+	at, err := parseSendAt(sendAt, timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// allow for clock skew between client and server, but not for stale requests
+	if at.Before(time.Now().Add(-time.Minute)) {
+		return time.Time{}, errors.New("send_at is in the past")
+	}
+	return at, nil
+}
+
+// Schedule stores msg to be sent at sendAt. Until then it stays in the scheduled state
+// and can be cancelled. As with Enqueue, an empty id is generated.
+func (q *MailQueue) Schedule(id string, msg Message, sendAt time.Time, timezone string) (QueuedMessage, error) {
+	id, err := messageID(id)
+	if err != nil {
+		return QueuedMessage{}, err
+	}
+	now := time.Now()
+	qm := QueuedMessage{
+		ID:          id,
+		Status:      StatusScheduled,
+		NextAttempt: sendAt,
+		SendAt:      &sendAt,
+		Timezone:    timezone,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		Message:     msg,
+	}
+	if err := q.Store.Create(qm); err != nil {
+		return QueuedMessage{}, err
+	}
+	return qm, nil
+}
+
+// Scheduled returns all messages waiting for their send time, soonest first.
+func (q *MailQueue) Scheduled() []QueuedMessage {
+	scheduled := q.Store.List(StatusScheduled)
+	sort.Slice(scheduled, func(i, j int) bool {
+		return scheduled[i].NextAttempt.Before(scheduled[j].NextAttempt)
+	})
+	return scheduled
+}
+
+// Cancel stops a scheduled message from being sent.
+func (q *MailQueue) Cancel(id string) (QueuedMessage, error) {
+	return q.Store.Update(id, func(qm *QueuedMessage) error {
+		if qm.Status != StatusScheduled {
+			return ErrNotScheduled
+		}
+		qm.Status = StatusCancelled
+		return nil
+	})
+}
+
+// schedule runs the scheduler loop, which hands messages whose send time has come to
+// the delivery workers.
+func (q *MailQueue) schedule() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if q.Store.ReleaseScheduled(time.Now()) == 0 {
+			continue
+		}
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
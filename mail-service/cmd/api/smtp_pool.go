@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// SMTPPool keeps SMTP connections open between messages, so bulk sends reuse a few
+// connections instead of dialing the server once per mail. At most Size connections
+// are in use at the same time, which also bounds the sending concurrency.
+type SMTPPool struct {
+	server      *mail.SMTPServer
+	idleTimeout time.Duration
+
+	slots chan struct{}
+	mu    sync.Mutex
+	idle  []pooledConn
+}
+
+type pooledConn struct {
+	client   *mail.SMTPClient
+	lastUsed time.Time
+}
+
+// NewSMTPPool creates a pool of at most size connections to server. Connections that
+// have not been used for idleTimeout are closed rather than reused, since most servers
+// drop idle clients on their side anyway.
+func NewSMTPPool(server *mail.SMTPServer, size int, idleTimeout time.Duration) *SMTPPool {
+	server.KeepAlive = true
+	return &SMTPPool{
+		server:      server,
+		idleTimeout: idleTimeout,
+		slots:       make(chan struct{}, size),
+	}
+}
+
+// Send runs send with a healthy connection from the pool. A connection that failed
+// while sending is closed instead of being returned, so the next caller reconnects.
+func (p *SMTPPool) Send(send func(*mail.SMTPClient) error) error {
+	p.slots <- struct{}{}
+	defer func() { <-p.slots }()
+
+	client, err := p.get()
+	if err != nil {
+		return err
+	}
+
+	err = send(client)
+	if err != nil {
+		client.Close()
+		return err
+	}
+	p.put(client)
+	return nil
+}
+
+// get returns an idle connection that still answers NOOP, or dials a new one.
+func (p *SMTPPool) get() (*mail.SMTPClient, error) {
+	for {
+		p.mu.Lock()
+		if len(p.idle) == 0 {
+			p.mu.Unlock()
+			break
+		}
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		p.mu.Unlock()
+
+		if time.Since(pc.lastUsed) > p.idleTimeout {
+			pc.client.Quit()
+			pc.client.Close()
+			continue
+		}
+		if err := pc.client.Noop(); err != nil {
+			log.Println("dropping broken SMTP connection:", err)
+			pc.client.Close()
+			continue
+		}
+		return pc.client, nil
+	}
+
+	return p.server.Connect()
+}
+
+func (p *SMTPPool) put(client *mail.SMTPClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.idle = append(p.idle, pooledConn{client: client, lastUsed: time.Now()})
+}
+
+// Close says goodbye to the server on every idle connection.
+func (p *SMTPPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pc := range p.idle {
+		pc.client.Quit()
+		pc.client.Close()
+	}
+	p.idle = nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	ttemplate "text/template"
+)
+
+const (
+	templatesDir    = "./templates"
+	localesDir      = "locales"
+	defaultTemplate = "mail"
+	htmlSuffix      = ".html.gohtml"
+	plainSuffix     = ".plain.gohtml"
+)
+
+// TemplateRegistry holds every mail template, parsed once at startup and keyed by name.
+// A template named "welcome" is made of welcome.html.gohtml and welcome.plain.gohtml,
+// and both files must define a "body" block.
+//
+// Templates may come in localized variants such as welcome.de.html.gohtml or
+// welcome.pt-BR.html.gohtml. Subject lines are translated with the JSON catalogs in
+// the locales directory, e.g. locales/de.json.
+type TemplateRegistry struct {
+	// html and plain are keyed by name, or name.locale for localized variants
+	html  map[string]*template.Template
+	plain map[string]*ttemplate.Template
+
+	// subjects maps a locale to its catalog of subject key to subject template
+	subjects map[string]map[string]*ttemplate.Template
+
+	// DefaultLocale is the last catalog tried when translating a subject.
+	DefaultLocale string
+}
+
+// NewTemplateRegistry parses all templates found in dir. Every HTML template needs a
+// plain text counterpart so that each message can be sent as multipart/alternative,
+// and every localized variant needs an unlocalized template of the same name.
+func NewTemplateRegistry(dir string) (*TemplateRegistry, error) {
+	reg := &TemplateRegistry{
+		html:          make(map[string]*template.Template),
+		plain:         make(map[string]*ttemplate.Template),
+		subjects:      make(map[string]map[string]*ttemplate.Template),
+		DefaultLocale: "en",
+	}
+
+	htmlFiles, err := filepath.Glob(filepath.Join(dir, "*"+htmlSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range htmlFiles {
+		key := strings.TrimSuffix(filepath.Base(file), htmlSuffix)
+		name, locale, localized := strings.Cut(key, ".")
+		if localized {
+			if !validLocale(locale) {
+				return nil, fmt.Errorf("template %s has an invalid locale: %s", file, locale)
+			}
+			key = name + "." + normalizeLocale(locale)
+		}
+
+		t, err := template.New(key + "-html").Funcs(template.FuncMap{"cid": cidURL}).ParseFiles(file)
+		if err != nil {
+			return nil, err
+		}
+
+		plainFile := strings.TrimSuffix(file, htmlSuffix) + plainSuffix
+		if _, err := os.Stat(plainFile); err != nil {
+			return nil, fmt.Errorf("template %s has no plain text version: %w", key, err)
+		}
+		pt, err := ttemplate.New(key + "-plain").ParseFiles(plainFile)
+		if err != nil {
+			return nil, err
+		}
+
+		reg.html[key] = t
+		reg.plain[key] = pt
+	}
+
+	for key := range reg.html {
+		if name, _, localized := strings.Cut(key, "."); localized && reg.html[name] == nil {
+			return nil, fmt.Errorf("template %s has no default version %s", key, name+htmlSuffix)
+		}
+	}
+
+	if _, ok := reg.html[defaultTemplate]; !ok {
+		return nil, fmt.Errorf("default template %s not found in %s", defaultTemplate, dir)
+	}
+
+	if err := reg.loadSubjects(filepath.Join(dir, localesDir)); err != nil {
+		return nil, err
+	}
+
+	return reg, nil
+}
+
+// loadSubjects parses the subject catalogs, one JSON object of key to subject per
+// locale. Subjects are text templates, so they can use the message data.
+func (reg *TemplateRegistry) loadSubjects(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		locale := strings.TrimSuffix(filepath.Base(file), ".json")
+		if !validLocale(locale) {
+			return fmt.Errorf("catalog %s has an invalid locale: %s", file, locale)
+		}
+		locale = normalizeLocale(locale)
+
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var entries map[string]string
+		if err := json.Unmarshal(b, &entries); err != nil {
+			return fmt.Errorf("catalog %s: %w", file, err)
+		}
+
+		catalog := make(map[string]*ttemplate.Template, len(entries))
+		for key, subject := range entries {
+			t, err := ttemplate.New(locale + ":" + key).Option("missingkey=zero").Parse(subject)
+			if err != nil {
+				return fmt.Errorf("catalog %s: %w", file, err)
+			}
+			catalog[key] = t
+		}
+		reg.subjects[locale] = catalog
+	}
+	return nil
+}
+
+// Names returns the sorted names of all registered templates.
+func (reg *TemplateRegistry) Names() []string {
+	names := make([]string, 0, len(reg.html))
+	for name := range reg.html {
+		if !strings.Contains(name, ".") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Has reports whether a template with the given name is registered. An empty name
+// refers to the default template.
+func (reg *TemplateRegistry) Has(name string) bool {
+	if name == "" {
+		name = defaultTemplate
+	}
+	_, ok := reg.html[name]
+	return ok && !strings.Contains(name, ".")
+}
+
+// resolve finds the best variant of a template for locale, trying the full locale
+// (pt-BR), then its language (pt) and finally the unlocalized template.
+func (reg *TemplateRegistry) resolve(name, locale string) string {
+	if name == "" {
+		name = defaultTemplate
+	}
+	for _, l := range localeChain(locale) {
+		if _, ok := reg.html[name+"."+l]; ok {
+			return name + "." + l
+		}
+	}
+	return name
+}
+
+// RenderHTML executes the "body" block of the named HTML template with data.
+func (reg *TemplateRegistry) RenderHTML(name, locale string, data map[string]any) (string, error) {
+	t, ok := reg.html[reg.resolve(name, locale)]
+	if !ok {
+		return "", fmt.Errorf("unknown template: %s", name)
+	}
+
+	var tpl bytes.Buffer
+	if err := t.ExecuteTemplate(&tpl, "body", data); err != nil {
+		return "", err
+	}
+	return tpl.String(), nil
+}
+
+// RenderPlain executes the "body" block of the named plain text template with data.
+func (reg *TemplateRegistry) RenderPlain(name, locale string, data map[string]any) (string, error) {
+	t, ok := reg.plain[reg.resolve(name, locale)]
+	if !ok {
+		return "", fmt.Errorf("unknown template: %s", name)
+	}
+
+	var tpl bytes.Buffer
+	if err := t.ExecuteTemplate(&tpl, "body", data); err != nil {
+		return "", err
+	}
+	return tpl.String(), nil
+}
+
+// Subject translates a subject line. key is looked up in the catalogs of locale, its
+// language and the default locale, in that order. ok is false when no catalog has it.
+func (reg *TemplateRegistry) Subject(key, locale string, data map[string]any) (subject string, ok bool, err error) {
+	for _, l := range append(localeChain(locale), reg.DefaultLocale) {
+		t, found := reg.subjects[l][key]
+		if !found {
+			continue
+		}
+		var b strings.Builder
+		if err := t.Execute(&b, data); err != nil {
+			return "", false, err
+		}
+		return b.String(), true, nil
+	}
+	return "", false, nil
+}
+
+// validLocale accepts BCP 47 style tags such as de, de-AT or pt_BR.
+func validLocale(locale string) bool {
+	if locale == "" || len(locale) > 35 {
+		return false
+	}
+	for _, part := range strings.FieldsFunc(locale, func(r rune) bool { return r == '-' || r == '_' }) {
+		for _, r := range part {
+			if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') {
+				return false
+			}
+		}
+	}
+	return !strings.ContainsAny(locale[:1], "-_") && !strings.ContainsAny(locale[len(locale)-1:], "-_")
+}
+
+// normalizeLocale turns de_at and DE-AT into de-AT, the form used as registry key.
+func normalizeLocale(locale string) string {
+	parts := strings.Split(strings.ReplaceAll(locale, "_", "-"), "-")
+	parts[0] = strings.ToLower(parts[0])
+	for i := 1; i < len(parts); i++ {
+		if len(parts[i]) == 2 {
+			parts[i] = strings.ToUpper(parts[i])
+		} else {
+			parts[i] = strings.ToLower(parts[i])
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// localeChain lists locale and its less specific forms, e.g. zh-hant-TW, zh-hant, zh.
+func localeChain(locale string) []string {
+	if locale == "" {
+		return nil
+	}
+	locale = normalizeLocale(locale)
+	var chain []string
+	for {
+		chain = append(chain, locale)
+		i := strings.LastIndex(locale, "-")
+		if i < 0 {
+			return chain
+		}
+		locale = locale[:i]
+	}
+}
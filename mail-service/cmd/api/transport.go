@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"toolbox/tracing"
+
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// Envelope is a fully rendered message, ready to be handed to a Transport.
+type Envelope struct {
+	From       string
+	Recipients []string
+	Message    Message
+	HTML       string
+	Plain      string
+	Raw        []byte
+}
+
+// Transport delivers rendered messages. Transports are selected with MAIL_TRANSPORTS.
+type Transport interface {
+	Name() string
+	Send(env Envelope) error
+}
+
+// SMTPTransport sends messages to the configured mail server over pooled connections.
+type SMTPTransport struct {
+	Pool *SMTPPool
+}
+
+func (t *SMTPTransport) Name() string { return "smtp" }
+
+func (t *SMTPTransport) Send(env Envelope) error {
+	return t.Pool.Send(func(c *mail.SMTPClient) error {
+		return mail.SendMessage(env.From, env.Recipients, string(env.Raw), c)
+	})
+}
+
+// FileTransport drops every message as an .eml file into a maildir (tmp, new, cur),
+// which is handy in development and tests where no mail server is around.
+type FileTransport struct {
+	Dir string
+}
+
+// NewFileTransport creates the maildir layout below dir.
+func NewFileTransport(dir string) (*FileTransport, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &FileTransport{Dir: dir}, nil
+}
+
+func (t *FileTransport) Name() string { return "file" }
+
+func (t *FileTransport) Send(env Envelope) error {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d.%s.eml", time.Now().UnixNano(), hex.EncodeToString(b))
+
+	// like maildir, write into tmp and move into new, so readers never see partial files
+	tmp := filepath.Join(t.Dir, "tmp", name)
+	if err := os.WriteFile(tmp, env.Raw, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(t.Dir, "new", name))
+}
+
+// HTTPTransport posts messages as JSON to a mail provider API. Most providers accept
+// a payload of this shape, and raw carries the exact MIME message for those that
+// prefer it.
+type HTTPTransport struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+type httpMailPayload struct {
+	From        string            `json:"from"`
+	To          []string          `json:"to"`
+	Cc          []string          `json:"cc,omitempty"`
+	Bcc         []string          `json:"bcc,omitempty"`
+	ReplyTo     string            `json:"reply_to,omitempty"`
+	Subject     string            `json:"subject"`
+	HTML        string            `json:"html"`
+	Text        string            `json:"text"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Attachments []Attachment      `json:"attachments,omitempty"`
+	Raw         []byte            `json:"raw"`
+}
+
+func (t *HTTPTransport) Name() string { return "http" }
+
+func (t *HTTPTransport) Send(env Envelope) error {
+	msg := env.Message
+	jsonData, err := json.Marshal(httpMailPayload{
+		From:        env.From,
+		To:          msg.To,
+		Cc:          msg.Cc,
+		Bcc:         msg.Bcc,
+		ReplyTo:     msg.ReplyTo,
+		Subject:     msg.Subject,
+		HTML:        env.HTML,
+		Text:        env.Plain,
+		Headers:     msg.Headers,
+		Attachments: msg.Attachments,
+		Raw:         env.Raw,
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", t.URL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if t.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+t.Token)
+	}
+
+	response, err := t.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("mail provider answered %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// FailoverTransport tries each transport in order and stops at the first success.
+type FailoverTransport struct {
+	Transports []Transport
+}
+
+func (t *FailoverTransport) Name() string {
+	names := make([]string, len(t.Transports))
+	for i, tr := range t.Transports {
+		names[i] = tr.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+func (t *FailoverTransport) Send(env Envelope) error {
+	var errs []error
+	for _, tr := range t.Transports {
+		err := tr.Send(env)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", tr.Name(), err))
+	}
+	return errors.Join(errs...)
+}
+
+// createTransport builds the transports listed in MAIL_TRANSPORTS (default "smtp"),
+// in failover order, e.g. MAIL_TRANSPORTS=http,smtp.
+func createTransport(m *Mail, poolSize int) (Transport, error) {
+	names := os.Getenv("MAIL_TRANSPORTS")
+	if names == "" {
+		names = "smtp"
+	}
+
+	var transports []Transport
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "smtp":
+			// reuse SMTP connections between messages instead of dialing for every mail
+			pool := NewSMTPPool(m.SMTPServer(), poolSize, 30*time.Second)
+			transports = append(transports, &SMTPTransport{Pool: pool})
+		case "file":
+			dir := os.Getenv("MAIL_FILE_DIR")
+			if dir == "" {
+				dir = "./maildir"
+			}
+			t, err := NewFileTransport(dir)
+			if err != nil {
+				return nil, err
+			}
+			transports = append(transports, t)
+		case "http":
+			url := os.Getenv("MAIL_HTTP_URL")
+			if url == "" {
+				return nil, errors.New("MAIL_HTTP_URL is required for the http transport")
+			}
+			transports = append(transports, &HTTPTransport{
+				URL:    url,
+				Token:  os.Getenv("MAIL_HTTP_TOKEN"),
+				Client: &http.Client{Timeout: 15 * time.Second, Transport: tracing.Transport(nil)},
+			})
+		default:
+			return nil, fmt.Errorf("unknown mail transport: %s", name)
+		}
+	}
+
+	if len(transports) == 1 {
+		return transports[0], nil
+	}
+	return &FailoverTransport{Transports: transports}, nil
+}
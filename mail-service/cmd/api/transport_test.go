@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testEnvelope() Envelope {
+	return Envelope{
+		From:       "sender@example.com",
+		Recipients: []string{"rcpt@example.org"},
+		Message:    Message{To: AddressList{"rcpt@example.org"}, Subject: "Hello"},
+		HTML:       "<p>Hello</p>",
+		Plain:      "Hello",
+		Raw:        []byte("From: sender@example.com\r\nTo: rcpt@example.org\r\nSubject: Hello\r\n\r\nHello\r\n"),
+	}
+}
+
+func TestHTTPTransport(t *testing.T) {
+	var got httpMailPayload
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	env := testEnvelope()
+	tr := &HTTPTransport{URL: srv.URL, Token: "secret", Client: srv.Client()}
+	if err := tr.Send(env); err != nil {
+		t.Fatal(err)
+	}
+	if auth != "Bearer secret" {
+		t.Errorf("got Authorization %q", auth)
+	}
+	if got.From != env.From || got.Subject != "Hello" || got.Text != "Hello" || string(got.Raw) != string(env.Raw) {
+		t.Errorf("got payload %+v", got)
+	}
+	if len(got.To) != 1 || got.To[0] != "rcpt@example.org" {
+		t.Errorf("got recipients %v", got.To)
+	}
+}
+
+func TestHTTPTransportReportsProviderErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "quota exceeded", http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	tr := &HTTPTransport{URL: srv.URL, Client: srv.Client()}
+	err := tr.Send(testEnvelope())
+	if err == nil || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Fatalf("got error %v", err)
+	}
+}
+
+func TestFileTransport(t *testing.T) {
+	dir := t.TempDir()
+	tr, err := NewFileTransport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := testEnvelope()
+	if err := tr.Send(env); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "new", "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got files %v, %v", files, err)
+	}
+	b, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string(env.Raw) {
+		t.Errorf("got message %q", b)
+	}
+	if tmp, _ := os.ReadDir(filepath.Join(dir, "tmp")); len(tmp) != 0 {
+		t.Errorf("%d files were left in tmp", len(tmp))
+	}
+}
+
+// failingTransport fails every message.
+type failingTransport struct{ sent int }
+
+func (t *failingTransport) Name() string { return "failing" }
+
+func (t *failingTransport) Send(env Envelope) error {
+	t.sent++
+	return errors.New("connection refused")
+}
+
+func TestFailoverTransport(t *testing.T) {
+	dir := t.TempDir()
+	file, err := NewFileTransport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := &failingTransport{}
+	tr := &FailoverTransport{Transports: []Transport{primary, file}}
+
+	if err := tr.Send(testEnvelope()); err != nil {
+		t.Fatal(err)
+	}
+	if primary.sent != 1 {
+		t.Errorf("the primary was tried %d times", primary.sent)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "new", "*.eml")); len(files) != 1 {
+		t.Errorf("the secondary delivered %d messages, want 1", len(files))
+	}
+	if name := tr.Name(); name != "failing,file" {
+		t.Errorf("got name %q", name)
+	}
+}
+
+func TestFailoverTransportReportsEveryError(t *testing.T) {
+	tr := &FailoverTransport{Transports: []Transport{&failingTransport{}, &failingTransport{}}}
+	err := tr.Send(testEnvelope())
+	if err == nil {
+		t.Fatal("no error when every transport failed")
+	}
+	if n := strings.Count(err.Error(), "failing: connection refused"); n != 2 {
+		t.Errorf("got error %q", err)
+	}
+}
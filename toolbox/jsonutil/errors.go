@@ -0,0 +1,135 @@
+package jsonutil
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Code tells clients what went wrong without parsing messages.
+type Code string
+
+const (
+	CodeBadRequest       Code = "bad_request"
+	CodeInvalidJSON      Code = "invalid_json"
+	CodeUnknownField     Code = "unknown_field"
+	CodeBodyTooLarge     Code = "body_too_large"
+	CodeValidation       Code = "validation_failed"
+	CodeUnauthorized     Code = "unauthorized"
+	CodeForbidden        Code = "forbidden"
+	CodeNotFound         Code = "not_found"
+	CodeMethodNotAllowed Code = "method_not_allowed"
+	CodeConflict         Code = "conflict"
+	CodeRateLimited      Code = "rate_limited"
+	CodeInternal         Code = "internal_error"
+	CodeBadGateway       Code = "bad_gateway"
+	CodeUnavailable      Code = "unavailable"
+	CodeTimeout          Code = "timeout"
+)
+
+// CodeFor is the code used for errors that only come with a status.
+func CodeFor(status int) Code {
+	switch status {
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return CodeBodyTooLarge
+	case http.StatusUnprocessableEntity:
+		return CodeValidation
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusBadGateway:
+		return CodeBadGateway
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	case http.StatusGatewayTimeout:
+		return CodeTimeout
+	}
+	if status >= 500 {
+		return CodeInternal
+	}
+	return CodeBadRequest
+}
+
+// FieldError is a problem with one field of a request.
+type FieldError struct {
+	// Field is the JSON path of the field, e.g. "to" or "attachments[0].filename".
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error is an error with the status and code to answer it with.
+type Error struct {
+	Status  int
+	Code    Code
+	Message string
+	Fields  []FieldError
+	Err     error
+}
+
+// NewError returns an error answered with status. An empty code is derived from
+// the status.
+func NewError(status int, code Code, message string) *Error {
+	if code == "" {
+		code = CodeFor(status)
+	}
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Problem is an RFC 7807 problem details document. Error and Message repeat the
+// outcome the way every other answer of the services carries it, so clients reading
+// {"error": true, "message": ...} keep working.
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     Code         `json:"code"`
+	Errors   []FieldError `json:"errors,omitempty"`
+	Error    bool         `json:"error"`
+	Message  string       `json:"message"`
+}
+
+// ProblemFor describes err. The status defaults to the one of an *Error, or 400.
+func ProblemFor(err error, status ...int) Problem {
+	e := &Error{Status: http.StatusBadRequest, Message: err.Error()}
+	var typed *Error
+	if errors.As(err, &typed) {
+		e = typed
+	}
+	statusCode := e.Status
+	if len(status) > 0 {
+		statusCode = status[0]
+	}
+	code := e.Code
+	if code == "" || statusCode != e.Status {
+		code = CodeFor(statusCode)
+	}
+	return Problem{
+		Type:    "about:blank",
+		Title:   http.StatusText(statusCode),
+		Status:  statusCode,
+		Detail:  e.Message,
+		Code:    code,
+		Errors:  e.Fields,
+		Error:   true,
+		Message: e.Message,
+	}
+}
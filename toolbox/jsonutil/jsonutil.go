@@ -0,0 +1,163 @@
+// Package jsonutil reads and writes the JSON bodies of the services, and answers
+// errors as problem details (RFC 7807).
+package jsonutil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// defaultMaxBytes is the body size allowed when Tools.MaxBytes is not set.
+const defaultMaxBytes = 1048576 // one megabyte
+
+// Response is the body of every answer: whether it is an error, a message, and the
+// data asked for.
+type Response struct {
+	Error   bool   `json:"error"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+// Tools holds the settings of the helpers. The zero value reads bodies of up to one
+// megabyte and rejects unknown fields.
+type Tools struct {
+	MaxBytes           int64
+	AllowUnknownFields bool
+}
+
+// ReadJSON decodes the single JSON value of the request body into data and validates
+// it (see Validate). Failures are returned as an *Error with the status to answer.
+func (t Tools) ReadJSON(w http.ResponseWriter, r *http.Request, data any) error {
+	maxBytes := t.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxBytes
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+
+	dec := json.NewDecoder(r.Body)
+	if !t.AllowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(data); err != nil {
+		return decodeError(err)
+	}
+	if err := dec.Decode(&struct{}{}); err != io.EOF {
+		return NewError(http.StatusBadRequest, CodeInvalidJSON, "body must have only a single JSON value")
+	}
+
+	return Validate(data)
+}
+
+func decodeError(err error) *Error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var tooLarge *http.MaxBytesError
+
+	e := NewError(http.StatusBadRequest, CodeInvalidJSON, err.Error())
+	e.Err = err
+	switch {
+	case errors.As(err, &tooLarge):
+		e.Status, e.Code = http.StatusRequestEntityTooLarge, CodeBodyTooLarge
+		e.Message = fmt.Sprintf("body must not be larger than %d bytes", tooLarge.Limit)
+	case errors.As(err, &syntaxErr):
+		e.Message = fmt.Sprintf("body contains badly-formed JSON (at character %d)", syntaxErr.Offset)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		e.Message = "body contains badly-formed JSON"
+	case errors.As(err, &typeErr):
+		if typeErr.Field != "" {
+			field := fieldPath(typeErr.Field)
+			e.Message = fmt.Sprintf("body contains an incorrect JSON type for field %q", field)
+			e.Fields = []FieldError{{Field: field, Code: "type", Message: "must be " + jsonType(typeErr.Type)}}
+		} else {
+			e.Message = fmt.Sprintf("body contains an incorrect JSON type (at character %d)", typeErr.Offset)
+		}
+	case errors.Is(err, io.EOF):
+		e.Message = "body must not be empty"
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		e.Code = CodeUnknownField
+		e.Message = "body contains unknown field " + field
+		e.Fields = []FieldError{{Field: strings.Trim(field, `"`), Code: "unknown", Message: "is not a known field"}}
+	}
+	return e
+}
+
+// fieldPath writes the dotted path of encoding/json, e.g. "attachments.0.name", the
+// way Validate does: "attachments[0].name".
+func fieldPath(field string) string {
+	var b strings.Builder
+	for i, part := range strings.Split(field, ".") {
+		switch {
+		case part != "" && strings.Trim(part, "0123456789") == "":
+			b.WriteString("[" + part + "]")
+		case i > 0:
+			b.WriteString("." + part)
+		default:
+			b.WriteString(part)
+		}
+	}
+	return b.String()
+}
+
+// jsonType names the JSON type t is decoded from.
+func jsonType(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Struct, reflect.Map:
+		return "an object"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	}
+	return "a " + t.String()
+}
+
+// WriteJSON writes data with status. The first of headers, if any, is added to the
+// response.
+func (t Tools) WriteJSON(w http.ResponseWriter, status int, data any, headers ...http.Header) error {
+	return write(w, "application/json", status, data, headers...)
+}
+
+// ErrorJSON answers err as a problem details document. The status is the one of an
+// *Error unless given, and 400 Bad Request otherwise.
+func (t Tools) ErrorJSON(w http.ResponseWriter, err error, status ...int) error {
+	return t.WriteProblem(w, ProblemFor(err, status...))
+}
+
+// WriteProblem answers with p.
+func (t Tools) WriteProblem(w http.ResponseWriter, p Problem, headers ...http.Header) error {
+	return write(w, "application/problem+json", p.Status, p, headers...)
+}
+
+func write(w http.ResponseWriter, contentType string, status int, data any, headers ...http.Header) error {
+	out, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if len(headers) > 0 {
+		for key, value := range headers[0] {
+			w.Header()[key] = value
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	_, err = w.Write(out)
+	return err
+}
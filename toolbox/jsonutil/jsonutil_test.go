@@ -0,0 +1,118 @@
+package jsonutil
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type logEntry struct {
+	Name  string   `json:"name" validate:"required"`
+	Count int      `json:"count"`
+	Tags  []string `json:"tags"`
+	Links []struct {
+		URL string `json:"url"`
+	} `json:"links"`
+}
+
+func TestReadJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		tools  Tools
+		body   string
+		status int
+		code   Code
+		field  string
+	}{
+		{name: "valid", body: `{"name": "event", "count": 2}`},
+		{name: "unknown field", body: `{"name": "event", "level": "info"}`, status: http.StatusBadRequest, code: CodeUnknownField, field: "level"},
+		{name: "unknown field allowed", tools: Tools{AllowUnknownFields: true}, body: `{"name": "event", "level": "info"}`},
+		{name: "trailing value", body: `{"name": "event"} {"name": "other"}`, status: http.StatusBadRequest, code: CodeInvalidJSON},
+		{name: "too large", tools: Tools{MaxBytes: 16}, body: `{"name": "a rather long event name"}`, status: http.StatusRequestEntityTooLarge, code: CodeBodyTooLarge},
+		{name: "type error", body: `{"name": "event", "count": "two"}`, status: http.StatusBadRequest, code: CodeInvalidJSON, field: "count"},
+		{name: "type error in list", body: `{"name": "event", "tags": ["a", 1]}`, status: http.StatusBadRequest, code: CodeInvalidJSON, field: "tags[1]"},
+		{name: "nested type error", body: `{"name": "event", "links": [{"url": 1}]}`, status: http.StatusBadRequest, code: CodeInvalidJSON, field: "links[0].url"},
+		{name: "syntax error", body: `{"name": }`, status: http.StatusBadRequest, code: CodeInvalidJSON},
+		{name: "truncated", body: `{"name": "event"`, status: http.StatusBadRequest, code: CodeInvalidJSON},
+		{name: "empty", body: ``, status: http.StatusBadRequest, code: CodeInvalidJSON},
+		{name: "invalid", body: `{"count": 2}`, status: http.StatusUnprocessableEntity, code: CodeValidation, field: "name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			var entry logEntry
+			err := tt.tools.ReadJSON(httptest.NewRecorder(), r, &entry)
+			if tt.status == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			var e *Error
+			if !errors.As(err, &e) {
+				t.Fatalf("got error %v, want an *Error", err)
+			}
+			if e.Status != tt.status || e.Code != tt.code {
+				t.Errorf("got %d %s (%s), want %d %s", e.Status, e.Code, e.Message, tt.status, tt.code)
+			}
+			if tt.field == "" {
+				if len(e.Fields) != 0 {
+					t.Errorf("got fields %+v", e.Fields)
+				}
+			} else if len(e.Fields) != 1 || e.Fields[0].Field != tt.field {
+				t.Errorf("got fields %+v, want %s", e.Fields, tt.field)
+			}
+		})
+	}
+}
+
+func TestProblemFor(t *testing.T) {
+	invalid := NewError(http.StatusUnprocessableEntity, "", "invalid request")
+	invalid.Fields = []FieldError{{Field: "name", Code: "required", Message: "is required"}}
+
+	tests := []struct {
+		name   string
+		err    error
+		status []int
+		want   int
+		code   Code
+	}{
+		{name: "plain error", err: errors.New("failed"), want: http.StatusBadRequest, code: CodeBadRequest},
+		{name: "plain error with status", err: errors.New("failed"), status: []int{http.StatusBadGateway}, want: http.StatusBadGateway, code: CodeBadGateway},
+		{name: "typed error", err: invalid, want: http.StatusUnprocessableEntity, code: CodeValidation},
+		{name: "wrapped error", err: errors.Join(errors.New("context"), invalid), want: http.StatusUnprocessableEntity, code: CodeValidation},
+		{name: "own code", err: NewError(http.StatusBadRequest, CodeUnknownField, "unknown field"), want: http.StatusBadRequest, code: CodeUnknownField},
+		{name: "same status", err: NewError(http.StatusBadRequest, CodeUnknownField, "unknown field"), status: []int{http.StatusBadRequest}, want: http.StatusBadRequest, code: CodeUnknownField},
+		{name: "status override", err: NewError(http.StatusBadRequest, CodeUnknownField, "unknown field"), status: []int{http.StatusServiceUnavailable}, want: http.StatusServiceUnavailable, code: CodeUnavailable},
+		{name: "unknown server status", err: errors.New("failed"), status: []int{http.StatusNotImplemented}, want: http.StatusNotImplemented, code: CodeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := ProblemFor(tt.err, tt.status...)
+			if p.Status != tt.want || p.Code != tt.code {
+				t.Errorf("got %d %s, want %d %s", p.Status, p.Code, tt.want, tt.code)
+			}
+			if p.Title != http.StatusText(tt.want) || !p.Error || p.Message == "" || p.Detail != p.Message {
+				t.Errorf("got problem %+v", p)
+			}
+		})
+	}
+
+	if p := ProblemFor(invalid); len(p.Errors) != 1 || p.Errors[0].Field != "name" {
+		t.Errorf("got errors %+v", p.Errors)
+	}
+}
+
+func TestErrorJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+	Tools{}.ErrorJSON(w, NewError(http.StatusNotFound, "", "no such entry"))
+	if w.Code != http.StatusNotFound || w.Header().Get("Content-Type") != "application/problem+json" {
+		t.Fatalf("got status %d with %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if body := w.Body.String(); !strings.Contains(body, `"code":"not_found"`) || !strings.Contains(body, `"message":"no such entry"`) {
+		t.Errorf("got %s", body)
+	}
+}
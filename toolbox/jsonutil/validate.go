@@ -0,0 +1,280 @@
+package jsonutil
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Validate checks the `validate` struct tags of v, a struct or a pointer to one, and
+// of the structs it holds. Rules are separated by commas:
+//
+//	required     the field must be set; blank strings and empty lists are not
+//	email        the string, or each string of a list, is a mail address
+//	min=n, max=n bounds on the length of a string or list, or on a number
+//	oneof=a b c  the string, or each string of a list, is one of the words
+//
+// Rules other than required pass for fields left empty. Failures are returned as an
+// *Error with status 422 listing every field at fault. Validate panics on rules it
+// does not know, so services check the tags of their payload types with MustCheckTags
+// when they start.
+func Validate(v any) error {
+	var fields []FieldError
+	validateValue(reflect.ValueOf(v), "", &fields)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	messages := make([]string, len(fields))
+	for i, f := range fields {
+		messages[i] = f.Field + " " + f.Message
+	}
+	e := NewError(http.StatusUnprocessableEntity, CodeValidation, "invalid request: "+strings.Join(messages, "; "))
+	e.Fields = fields
+	return e
+}
+
+func validateValue(v reflect.Value, path string, fields *[]FieldError) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			if !sf.IsExported() {
+				continue
+			}
+			name := fieldName(sf)
+			if name == "-" {
+				continue
+			}
+			fieldPath := name
+			if sf.Anonymous && name == sf.Name {
+				// embedded structs lend their fields to the outer one
+				fieldPath = path
+			} else if path != "" {
+				fieldPath = path + "." + name
+			}
+			fv := v.Field(i)
+			if rules := sf.Tag.Get("validate"); rules != "" {
+				if f, ok := checkRules(fv, rules); !ok {
+					f.Field = fieldPath
+					*fields = append(*fields, f)
+					continue
+				}
+			}
+			validateValue(fv, fieldPath, fields)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			validateValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), fields)
+		}
+	}
+}
+
+// CheckTags returns an error for the first `validate` tag of the types of values, or
+// of the structs they hold, with a rule Validate does not know or a bad argument.
+func CheckTags(values ...any) error {
+	seen := make(map[reflect.Type]bool)
+	for _, v := range values {
+		if err := checkType(reflect.TypeOf(v), seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MustCheckTags is like CheckTags but panics on a bad tag. It is meant for the init of
+// the package declaring the types.
+func MustCheckTags(values ...any) {
+	if err := CheckTags(values...); err != nil {
+		panic(err)
+	}
+}
+
+func checkType(t reflect.Type, seen map[reflect.Type]bool) error {
+	for t != nil && (t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct || seen[t] {
+		return nil
+	}
+	seen[t] = true
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() || fieldName(sf) == "-" {
+			continue
+		}
+		if rules := sf.Tag.Get("validate"); rules != "" {
+			for _, rule := range strings.Split(rules, ",") {
+				if err := checkRule(rule); err != nil {
+					return fmt.Errorf("jsonutil: field %s of %s: %w", sf.Name, t, err)
+				}
+			}
+		}
+		if err := checkType(sf.Type, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRule returns an error for a rule Validate would panic on.
+func checkRule(rule string) error {
+	name, arg, _ := strings.Cut(rule, "=")
+	switch name {
+	case "required", "email":
+	case "min", "max":
+		if _, err := strconv.ParseFloat(arg, 64); err != nil {
+			return fmt.Errorf("invalid %s bound %q", name, arg)
+		}
+	case "oneof":
+		if len(strings.Fields(arg)) == 0 {
+			return errors.New("oneof lists no words")
+		}
+	default:
+		return fmt.Errorf("unknown validation rule %q", name)
+	}
+	return nil
+}
+
+// fieldName is the name of the field in JSON.
+func fieldName(sf reflect.StructField) string {
+	name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+	if name == "" {
+		return sf.Name
+	}
+	return name
+}
+
+// checkRules returns the first rule v breaks.
+func checkRules(v reflect.Value, rules string) (FieldError, bool) {
+	v = indirect(v)
+	empty := isEmpty(v)
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		if name == "required" {
+			if empty {
+				return FieldError{Code: "required", Message: "is required"}, false
+			}
+			continue
+		}
+		if empty {
+			continue
+		}
+
+		switch name {
+		case "email":
+			valid := eachString(v, func(s string) bool {
+				_, err := mail.ParseAddress(s)
+				return err == nil
+			})
+			if !valid {
+				return FieldError{Code: "email", Message: "must be a valid email address"}, false
+			}
+		case "min", "max":
+			if f, ok := checkBound(v, name, arg); !ok {
+				return f, false
+			}
+		case "oneof":
+			words := strings.Fields(arg)
+			valid := eachString(v, func(s string) bool {
+				for _, w := range words {
+					if s == w {
+						return true
+					}
+				}
+				return false
+			})
+			if !valid {
+				return FieldError{Code: "oneof", Message: "must be one of " + strings.Join(words, ", ")}, false
+			}
+		default:
+			panic("jsonutil: unknown validation rule " + name)
+		}
+	}
+	return FieldError{}, true
+}
+
+// eachString checks the string v, or every string of the list v.
+func eachString(v reflect.Value, valid func(string) bool) bool {
+	switch v.Kind() {
+	case reflect.String:
+		return valid(v.String())
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if !eachString(indirect(v.Index(i)), valid) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func checkBound(v reflect.Value, rule, arg string) (FieldError, bool) {
+	limit, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		panic("jsonutil: invalid " + rule + " bound " + arg)
+	}
+	above := rule == "max"
+
+	var n float64
+	var unit string
+	switch v.Kind() {
+	case reflect.String:
+		n, unit = float64(utf8.RuneCountInString(v.String())), " characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		n, unit = float64(v.Len()), " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		n = v.Float()
+	default:
+		return FieldError{}, true
+	}
+
+	if above && n > limit {
+		return FieldError{Code: "max", Message: "must be at most " + arg + unit}, false
+	}
+	if !above && n < limit {
+		return FieldError{Code: "min", Message: "must be at least " + arg + unit}, false
+	}
+	return FieldError{}, true
+}
+
+func isEmpty(v reflect.Value) bool {
+	v = indirect(v)
+	switch v.Kind() {
+	case reflect.Invalid:
+		return true
+	case reflect.String:
+		return strings.TrimSpace(v.String()) == ""
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+func indirect(v reflect.Value) reflect.Value {
+	for (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		return reflect.Value{}
+	}
+	return v
+}
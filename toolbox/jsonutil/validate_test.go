@@ -0,0 +1,157 @@
+package jsonutil
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type attachment struct {
+	Name string `json:"name" validate:"required,max=8"`
+}
+
+type Envelope struct {
+	From string `json:"from" validate:"email"`
+}
+
+type message struct {
+	Envelope
+	To          []string     `json:"to" validate:"required,email,max=2"`
+	Subject     string       `json:"subject" validate:"min=2,max=5"`
+	Priority    *int         `json:"priority,omitempty" validate:"min=1,max=5"`
+	Reason      string       `json:"reason" validate:"oneof=hard soft"`
+	Tags        []string     `json:"tags" validate:"oneof=a b"`
+	Attachments []attachment `json:"attachments"`
+	Reply       *attachment  `json:"reply"`
+	Meta        struct {
+		Count float64 `validate:"max=1.5"`
+	} `json:"meta"`
+	Ignored string `json:"-" validate:"required"`
+	hidden  string `validate:"required"`
+}
+
+func TestValidate(t *testing.T) {
+	three := 3
+	zero := 0
+	valid := func() message {
+		return message{To: []string{"rcpt@example.org"}}
+	}
+	tests := []struct {
+		name   string
+		modify func(m *message)
+		field  string
+		code   string
+	}{
+		{name: "valid", modify: func(m *message) {}},
+		{name: "all set", modify: func(m *message) {
+			m.From, m.Subject, m.Priority, m.Reason, m.Tags = "me@example.com", "Hi", &three, "soft", []string{"a", "b"}
+			m.Attachments = []attachment{{Name: "a.txt"}}
+		}},
+		{name: "required", modify: func(m *message) { m.To = nil }, field: "to", code: "required"},
+		{name: "required blank", modify: func(m *message) { m.To = []string{} }, field: "to", code: "required"},
+		{name: "email in list", modify: func(m *message) { m.To = []string{"rcpt@example.org", "nobody"} }, field: "to", code: "email"},
+		{name: "list max", modify: func(m *message) { m.To = []string{"a@example.org", "b@example.org", "c@example.org"} }, field: "to", code: "max"},
+		{name: "string min", modify: func(m *message) { m.Subject = "H" }, field: "subject", code: "min"},
+		{name: "string max", modify: func(m *message) { m.Subject = "Hello!" }, field: "subject", code: "max"},
+		{name: "string max in characters", modify: func(m *message) { m.Subject = "Grüße" }},
+		{name: "blank string is empty", modify: func(m *message) { m.Subject = " " }},
+		{name: "number max", modify: func(m *message) { m.Priority = &three; *m.Priority = 6 }, field: "priority", code: "max"},
+		{name: "zero is empty", modify: func(m *message) { m.Priority = &zero }},
+		{name: "fractional bound", modify: func(m *message) { m.Meta.Count = 1.6 }, field: "meta.Count", code: "max"},
+		{name: "oneof", modify: func(m *message) { m.Reason = "hardest" }, field: "reason", code: "oneof"},
+		{name: "oneof in list", modify: func(m *message) { m.Tags = []string{"a", "c"} }, field: "tags", code: "oneof"},
+		{name: "embedded", modify: func(m *message) { m.From = "me" }, field: "from", code: "email"},
+		{name: "list of structs", modify: func(m *message) { m.Attachments = []attachment{{Name: "a"}, {}} }, field: "attachments[1].name", code: "required"},
+		{name: "pointer to struct", modify: func(m *message) { m.Reply = &attachment{Name: "too long.txt"} }, field: "reply.name", code: "max"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := valid()
+			tt.modify(&m)
+			err := Validate(&m)
+			if tt.field == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			var e *Error
+			if !errors.As(err, &e) || e.Status != http.StatusUnprocessableEntity || e.Code != CodeValidation {
+				t.Fatalf("got error %v, want a validation error", err)
+			}
+			if len(e.Fields) != 1 || e.Fields[0].Field != tt.field || e.Fields[0].Code != tt.code {
+				t.Errorf("got fields %+v, want %s %s", e.Fields, tt.field, tt.code)
+			}
+		})
+	}
+}
+
+func TestValidateListsEveryField(t *testing.T) {
+	err := Validate(message{Subject: "H", Attachments: []attachment{{}}})
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("got error %v", err)
+	}
+	var fields []string
+	for _, f := range e.Fields {
+		fields = append(fields, f.Field)
+	}
+	if got := strings.Join(fields, " "); got != "to subject attachments[0].name" {
+		t.Errorf("got fields %s", got)
+	}
+	if !strings.Contains(e.Message, "to is required; subject must be at least 2 characters") {
+		t.Errorf("got message %q", e.Message)
+	}
+}
+
+func TestCheckTags(t *testing.T) {
+	type unknownRule struct {
+		Name string `validate:"required,emial"`
+	}
+	type badBound struct {
+		Name string `validate:"max=ten"`
+	}
+	type emptyOneof struct {
+		Reason string `validate:"oneof="`
+	}
+	type nested struct {
+		Items []*unknownRule
+	}
+	tests := []struct {
+		name  string
+		value any
+		err   string
+	}{
+		{name: "valid", value: message{}},
+		{name: "pointer", value: &message{}},
+		{name: "no tags", value: struct{ Name string }{}},
+		{name: "not a struct", value: 1},
+		{name: "unknown rule", value: unknownRule{}, err: `field Name of jsonutil.unknownRule: unknown validation rule "emial"`},
+		{name: "bad bound", value: badBound{}, err: `invalid max bound "ten"`},
+		{name: "empty oneof", value: emptyOneof{}, err: "oneof lists no words"},
+		{name: "nested", value: nested{}, err: `unknown validation rule "emial"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckTags(tt.value)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+
+			defer func() {
+				if recover() == nil {
+					t.Error("MustCheckTags did not panic")
+				}
+			}()
+			MustCheckTags(tt.value)
+		})
+	}
+}
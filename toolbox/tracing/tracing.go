@@ -0,0 +1,179 @@
+// Package tracing sets up OpenTelemetry for a service and carries the W3C trace
+// context over the transports the services talk to each other with: HTTP, gRPC,
+// net/rpc and AMQP.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentation names the tracer of the spans started here.
+const instrumentation = "toolbox/tracing"
+
+// Init installs the tracer provider of service and the W3C trace context propagator.
+// OTEL_TRACES_EXPORTER picks where spans go:
+//
+//	otlp     an OpenTelemetry collector, configured by the OTEL_EXPORTER_OTLP_* variables
+//	file     JSON lines appended to OTEL_TRACES_FILE, for tests and local runs
+//	console  standard output
+//	none     nowhere; the context is still propagated
+//
+// It defaults to otlp when OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set, and to none otherwise. OTEL_SERVICE_NAME
+// overrides service. The returned func flushes the spans not yet exported.
+func Init(service string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	exporter, err := newExporter()
+	if err != nil {
+		return nil, err
+	}
+	if exporter == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.New(context.Background(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(semconv.ServiceName(service)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+func newExporter() (sdktrace.SpanExporter, error) {
+	kind := os.Getenv("OTEL_TRACES_EXPORTER")
+	if kind == "" {
+		kind = "none"
+		if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+			kind = "otlp"
+		}
+	}
+
+	switch kind {
+	case "otlp":
+		return otlptracehttp.New(context.Background())
+	case "file":
+		name := os.Getenv("OTEL_TRACES_FILE")
+		if name == "" {
+			return nil, fmt.Errorf("OTEL_TRACES_EXPORTER is file but OTEL_TRACES_FILE is not set")
+		}
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		return stdouttrace.New(stdouttrace.WithWriter(f))
+	case "console":
+		return stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "none":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q", kind)
+}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(instrumentation)
+}
+
+// End ends span, marking it failed when err is set.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// StartRPCClient starts the span of a net/rpc call to method. The returned carrier
+// holds the trace context for the server; it travels in the TraceContext field of
+// the arguments, which servers not knowing about it simply ignore.
+func StartRPCClient(ctx context.Context, method string) (context.Context, trace.Span, map[string]string) {
+	ctx, span := tracer().Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.RPCSystemKey.String("net_rpc"), semconv.RPCMethod(method)),
+	)
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return ctx, span, carrier
+}
+
+// StartRPCServer starts the span of a net/rpc method serving a call whose arguments
+// carried traceContext.
+func StartRPCServer(traceContext map[string]string, method string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(traceContext))
+	return tracer().Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.RPCSystemKey.String("net_rpc"), semconv.RPCMethod(method)),
+	)
+}
+
+// tableCarrier carries the trace context in the headers of an AMQP message.
+type tableCarrier map[string]any
+
+func (c tableCarrier) Get(key string) string {
+	s, _ := c[key].(string)
+	return s
+}
+
+func (c tableCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c tableCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// StartPublish starts the span of publishing an AMQP message under key, and returns
+// the headers to publish it with (an amqp.Table).
+func StartPublish(ctx context.Context, exchange, key string) (context.Context, trace.Span, map[string]any) {
+	ctx, span := tracer().Start(ctx, exchange+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(messagingAttributes(exchange, key)...),
+	)
+	headers := map[string]any{}
+	otel.GetTextMapPropagator().Inject(ctx, tableCarrier(headers))
+	return ctx, span, headers
+}
+
+// StartConsume starts the span of processing an AMQP message delivered with headers,
+// continuing the trace of its publisher.
+func StartConsume(exchange, key string, headers map[string]any) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), tableCarrier(headers))
+	return tracer().Start(ctx, exchange+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(messagingAttributes(exchange, key)...),
+	)
+}
+
+func messagingAttributes(exchange, key string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.MessagingSystemRabbitmq,
+		semconv.MessagingDestinationName(exchange),
+		semconv.MessagingRabbitmqDestinationRoutingKey(key),
+	}
+}
@@ -0,0 +1,188 @@
+package tracing
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// newRecorder makes every span end up in the returned exporter.
+func newRecorder(t *testing.T) *tracetest.InMemoryExporter {
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	if _, err := Init("test"); err != nil {
+		t.Fatal(err)
+	}
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		provider.Shutdown(context.Background())
+	})
+	return exporter
+}
+
+// LogArgs are the arguments of a net/rpc call, with the trace context added by callers.
+type LogArgs struct {
+	Name         string
+	TraceContext map[string]string
+}
+
+// LogServer stands in for the logger: it continues the trace of every call.
+type LogServer struct{}
+
+func (LogServer) LogInfo(args LogArgs, reply *string) error {
+	_, span := StartRPCServer(args.TraceContext, "LogServer.LogInfo")
+	defer span.End()
+	*reply = "logged " + args.Name
+	return nil
+}
+
+func newLogServer(t *testing.T) *rpc.Client {
+	server := rpc.NewServer()
+	if err := server.Register(LogServer{}); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go server.Accept(ln)
+
+	client, err := rpc.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func newHealthServer(t *testing.T) healthpb.HealthClient {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.UnaryInterceptor(UnaryServerInterceptor()))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(ln)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial(ln.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(UnaryClientInterceptor()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return healthpb.NewHealthClient(conn)
+}
+
+// TestPropagation follows a request from a client to the broker, and from there over
+// net/rpc, gRPC and AMQP to the services behind it.
+func TestPropagation(t *testing.T) {
+	exporter := newRecorder(t)
+	logger := newLogServer(t)
+	grpcService := newHealthServer(t)
+
+	var published map[string]any
+	broker := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span, traceContext := StartRPCClient(r.Context(), "LogServer.LogInfo")
+		var reply string
+		err := logger.Call("LogServer.LogInfo", LogArgs{Name: "event", TraceContext: traceContext}, &reply)
+		End(span, err)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if _, err := grpcService.Check(r.Context(), &healthpb.HealthCheckRequest{}); err != nil {
+			t.Error(err)
+		}
+
+		_, span, published = StartPublish(r.Context(), "logs_topic", "log.INFO")
+		End(span, nil)
+		w.WriteHeader(http.StatusAccepted)
+	})))
+	defer broker.Close()
+
+	client := &http.Client{Transport: Transport(nil)}
+	res, err := client.Post(broker.URL+"/handle", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	// the listener picks the message up later, without any context but its headers
+	_, span := StartConsume("logs_topic", "log.INFO", published)
+	span.End()
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, s := range exporter.GetSpans() {
+		key := s.SpanKind.String() + " " + s.Name
+		if _, ok := spans[key]; ok {
+			t.Fatalf("span %s was recorded twice", key)
+		}
+		spans[key] = s
+	}
+	get := func(key string) tracetest.SpanStub {
+		s, ok := spans[key]
+		if !ok {
+			names := make([]string, 0, len(spans))
+			for name := range spans {
+				names = append(names, name)
+			}
+			t.Fatalf("no span %s among %q", key, names)
+		}
+		return s
+	}
+
+	httpClient := get("client POST")
+	traceID := httpClient.SpanContext.TraceID()
+	for key, s := range spans {
+		if s.SpanContext.TraceID() != traceID {
+			t.Errorf("span %s is in trace %s, want %s", key, s.SpanContext.TraceID(), traceID)
+		}
+	}
+	if httpClient.Parent.IsValid() {
+		t.Error("the span of the client has a parent")
+	}
+
+	for _, link := range []struct{ child, parent string }{
+		{"server POST", "client POST"},
+		{"client LogServer.LogInfo", "server POST"},
+		{"server LogServer.LogInfo", "client LogServer.LogInfo"},
+		{"client /grpc.health.v1.Health/Check", "server POST"},
+		{"server /grpc.health.v1.Health/Check", "client /grpc.health.v1.Health/Check"},
+		{"producer logs_topic publish", "server POST"},
+		{"consumer logs_topic process", "producer logs_topic publish"},
+	} {
+		child, parent := get(link.child), get(link.parent)
+		if child.Parent.SpanID() != parent.SpanContext.SpanID() {
+			t.Errorf("the parent of %s is %s, want %s (%s)", link.child, child.Parent.SpanID(), link.parent, parent.SpanContext.SpanID())
+		}
+	}
+}
+
+func TestEndRecordsErrors(t *testing.T) {
+	exporter := newRecorder(t)
+	_, span := otel.Tracer("test").Start(context.Background(), "failing")
+	End(span, net.ErrClosed)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Status.Description != net.ErrClosed.Error() || len(spans[0].Events) != 1 {
+		t.Fatalf("got spans %+v", spans)
+	}
+}
@@ -0,0 +1,81 @@
+// Package web holds the HTTP middleware every service puts in front of its routes.
+package web
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/cors"
+)
+
+// DefaultAllowedOrigins are used when CORS_ALLOWED_ORIGINS is not set: the front end,
+// as started by `make start`.
+var DefaultAllowedOrigins = []string{"http://localhost:8082"}
+
+// DefaultAllowedHeaders are the request headers browsers may send to any service.
+var DefaultAllowedHeaders = []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"}
+
+// defaultMaxAge is how long, in seconds, browsers may cache a preflight answer.
+const defaultMaxAge = 300
+
+// CORSOptions adds to the Cross-Origin Resource Sharing settings shared by the
+// services.
+type CORSOptions struct {
+	// AllowedOrigins replaces the origins read from CORS_ALLOWED_ORIGINS.
+	AllowedOrigins []string
+	// AllowedHeaders are allowed on top of DefaultAllowedHeaders.
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers scripts may read, besides the simple
+	// ones.
+	ExposedHeaders []string
+}
+
+// CORS specifies who is allowed to connect. Origins are read from CORS_ALLOWED_ORIGINS,
+// a comma separated list such as "https://app.example.com,https://*.example.com".
+// Credentials are allowed, unless any origin ("*") is, as browsers would then send
+// them from every site.
+func CORS(opts CORSOptions) func(http.Handler) http.Handler {
+	origins := opts.AllowedOrigins
+	if len(origins) == 0 {
+		origins = originsFromEnv()
+	}
+	credentials := true
+	for _, origin := range origins {
+		if origin == "*" {
+			credentials = false
+		}
+	}
+
+	maxAge := defaultMaxAge
+	if s := os.Getenv("CORS_MAX_AGE"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			panic("invalid CORS_MAX_AGE: " + s)
+		}
+		maxAge = n
+	}
+
+	return cors.Handler(cors.Options{
+		AllowedOrigins:   origins,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedHeaders:   append(append([]string{}, DefaultAllowedHeaders...), opts.AllowedHeaders...),
+		ExposedHeaders:   append([]string{"Link"}, opts.ExposedHeaders...),
+		AllowCredentials: credentials,
+		MaxAge:           maxAge,
+	})
+}
+
+func originsFromEnv() []string {
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	if len(origins) == 0 {
+		return DefaultAllowedOrigins
+	}
+	return origins
+}
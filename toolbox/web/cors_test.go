@@ -0,0 +1,104 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+// preflight sends the preflight request of a browser at origin through h.
+func preflight(h http.Handler, origin string) http.Header {
+	r := httptest.NewRequest(http.MethodOptions, "/", nil)
+	r.Header.Set("Origin", origin)
+	r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Header()
+}
+
+func TestCORSOrigins(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         string
+		opts        CORSOptions
+		origin      string
+		allowed     string
+		credentials string
+	}{
+		{name: "default", origin: "http://localhost:8082", allowed: "http://localhost:8082", credentials: "true"},
+		{name: "not the default", origin: "http://localhost:8080"},
+		{name: "listed", env: " https://app.example.com , https://*.example.org,,", origin: "https://app.example.com", allowed: "https://app.example.com", credentials: "true"},
+		{name: "wildcard", env: "https://app.example.com,https://*.example.org", origin: "https://admin.example.org", allowed: "https://admin.example.org", credentials: "true"},
+		{name: "not listed", env: "https://app.example.com", origin: "https://evil.example.net"},
+		{name: "blank", env: " , ", origin: "http://localhost:8082", allowed: "http://localhost:8082", credentials: "true"},
+		{name: "any origin", env: "*", origin: "https://evil.example.net", allowed: "*"},
+		{name: "any origin among others", env: "https://app.example.com,*", origin: "https://app.example.com", allowed: "*"},
+		{name: "options over env", env: "https://app.example.com", opts: CORSOptions{AllowedOrigins: []string{"https://other.example.com"}}, origin: "https://other.example.com", allowed: "https://other.example.com", credentials: "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CORS_ALLOWED_ORIGINS", tt.env)
+			h := preflight(CORS(tt.opts)(okHandler), tt.origin)
+			if got := h.Get("Access-Control-Allow-Origin"); got != tt.allowed {
+				t.Errorf("got allowed origin %q, want %q", got, tt.allowed)
+			}
+			if got := h.Get("Access-Control-Allow-Credentials"); got != tt.credentials {
+				t.Errorf("got allowed credentials %q, want %q", got, tt.credentials)
+			}
+		})
+	}
+}
+
+func TestCORSHeaders(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", "")
+	h := CORS(CORSOptions{AllowedHeaders: []string{"Idempotency-Key"}, ExposedHeaders: []string{"Retry-After"}})(okHandler)
+
+	r := httptest.NewRequest(http.MethodOptions, "/", nil)
+	r.Header.Set("Origin", "http://localhost:8082")
+	r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	r.Header.Set("Access-Control-Request-Headers", "Authorization, Idempotency-Key")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get("Access-Control-Allow-Headers"); got != "Authorization, Idempotency-Key" {
+		t.Errorf("got allowed headers %q", got)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Origin", "http://localhost:8082")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if got := w.Header().Get("Access-Control-Expose-Headers"); got != "Link, Retry-After" {
+		t.Errorf("got exposed headers %q", got)
+	}
+}
+
+func TestCORSMaxAge(t *testing.T) {
+	tests := []struct {
+		env   string
+		want  string
+		panic bool
+	}{
+		{env: "", want: "300"},
+		{env: "600", want: "600"},
+		{env: "0", want: ""},
+		{env: "-1", panic: true},
+		{env: "5m", panic: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv("CORS_ALLOWED_ORIGINS", "")
+			t.Setenv("CORS_MAX_AGE", tt.env)
+			defer func() {
+				if r := recover(); (r != nil) != tt.panic {
+					t.Errorf("got panic %v", r)
+				}
+			}()
+			h := preflight(CORS(CORSOptions{})(okHandler), "http://localhost:8082")
+			if got := h.Get("Access-Control-Max-Age"); got != tt.want {
+				t.Errorf("got max age %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
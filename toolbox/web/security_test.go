@@ -0,0 +1,80 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func securityHeaders(t *testing.T, opts SecurityOptions) http.Header {
+	t.Helper()
+	w := httptest.NewRecorder()
+	SecurityHeaders(opts)(okHandler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	return w.Header()
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	t.Setenv("CONTENT_SECURITY_POLICY", "")
+	t.Setenv("HSTS_MAX_AGE", "")
+	h := securityHeaders(t, SecurityOptions{})
+	for key, want := range map[string]string{
+		"Strict-Transport-Security": "max-age=63072000; includeSubDomains",
+		"Content-Security-Policy":   APIContentSecurityPolicy,
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "DENY",
+		"Referrer-Policy":           "no-referrer",
+	} {
+		if got := h.Get(key); got != want {
+			t.Errorf("got %s %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestContentSecurityPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		opts SecurityOptions
+		want string
+	}{
+		{name: "default", want: APIContentSecurityPolicy},
+		{name: "options", opts: SecurityOptions{ContentSecurityPolicy: "default-src 'self'"}, want: "default-src 'self'"},
+		{name: "env", env: "default-src https:", want: "default-src https:"},
+		{name: "env over options", env: "default-src https:", opts: SecurityOptions{ContentSecurityPolicy: "default-src 'self'"}, want: "default-src https:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CONTENT_SECURITY_POLICY", tt.env)
+			if got := securityHeaders(t, tt.opts).Get("Content-Security-Policy"); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHSTSMaxAge(t *testing.T) {
+	tests := []struct {
+		env   string
+		want  string
+		panic bool
+	}{
+		{env: "", want: "max-age=63072000; includeSubDomains"},
+		{env: "1h", want: "max-age=3600; includeSubDomains"},
+		{env: "0", want: ""},
+		{env: "-1h", panic: true},
+		{env: "3600", panic: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv("HSTS_MAX_AGE", tt.env)
+			defer func() {
+				if r := recover(); (r != nil) != tt.panic {
+					t.Errorf("got panic %v", r)
+				}
+			}()
+			if got := securityHeaders(t, SecurityOptions{}).Get("Strict-Transport-Security"); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}